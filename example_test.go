@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	"runny/src/runny"
 	"testing"
 )
 
@@ -32,6 +34,7 @@ func TestExamples(t *testing.T) {
 					},
 				}
 				runny.Run()
+				runExampleTests(t, path)
 			})
 		}
 
@@ -42,3 +45,20 @@ func TestExamples(t *testing.T) {
 		t.Fatalf("error walking the directory: %v", err)
 	}
 }
+
+// examples with test blocks must pass them
+func runExampleTests(t *testing.T, path string) {
+	project, err := runny.Load(context.Background(), path, runny.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range project.Tests {
+		result, err := project.Test(context.Background(), test.Name, runny.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Passed() {
+			t.Errorf("test '%s' failed: %v %v", test.Name, result.Failures, result.Err)
+		}
+	}
+}
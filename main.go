@@ -1,111 +1,484 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"runny/src/interpreter"
 	"runny/src/lex"
-	"runny/src/parser"
+	"runny/src/runny"
+	"runny/src/trace"
+	"runny/src/workspace"
+	"slices"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
 type Runny struct {
-	Config Config
+	Config   Config
+	ExitCode int
+	handler  runny.Handler // where events are written with --output=json
 }
 
 func (r *Runny) Run() {
-	fileContents, err := os.ReadFile(r.Config.File)
-	if err != nil {
-		fmt.Println("error reading file:", err)
+	// stop fetching files and running commands on ctrl+c
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if r.Config.Trace != "" {
+		tracer := trace.New()
+		ctx = trace.WithTracer(ctx, tracer)
+		defer r.writeTrace(tracer)
+	}
+
+	loadOpts := runny.LoadOptions{
+		Offline: r.Config.Offline,
+	}
+	opts := runny.Options{
+		Set:       r.Config.Set,
+		Detach:    r.Config.Testing,
+		Verbosity: r.Config.Verbosity,
+		Colour:    useColour(),
+	}
+	if r.Config.Output == "json" {
+		r.handler = runny.NewJSONHandler(os.Stdout)
+		opts.Handler = r.handler
+	}
+	if r.Config.JUnit != "" {
+		junit := &runny.JUnit{Actions: r.Config.JUnitActions}
+		opts.Listeners = append(opts.Listeners, junit)
+		defer r.writeJUnit(junit)
+	}
+
+	if r.Config.Workspace {
+		ws, err := workspace.Discover(filepath.Dir(r.Config.File))
+		if err != nil {
+			r.printError(err)
+			r.ExitCode = 1
+			return
+		}
+		r.runWorkspace(ctx, ws, workspace.Options{
+			Options:  opts,
+			Load:     loadOpts,
+			Parallel: r.Config.Parallel,
+		})
+		return
 	}
 
-	lexer := lex.New()
-	tokens, err := lexer.ReadInput(string(fileContents))
+	project, err := runny.Load(ctx, r.Config.File, loadOpts)
+
+	// targets in other packages are addressed like services/api:build, and imported ones like ci:build
+	if prefix, _, found := strings.Cut(r.Config.Target, ":"); found && (err != nil || !slices.Contains(project.Imports, prefix)) {
+		ws, wsErr := workspace.Discover(filepath.Dir(r.Config.File))
+		if wsErr != nil {
+			r.printError(wsErr)
+			r.ExitCode = 1
+			return
+		}
+		if pkg, target, ok := ws.Resolve(r.Config.Target); ok {
+			r.Config.File = pkg.File
+			r.Config.Target = target
+			opts.Dir = filepath.Dir(pkg.File)
+			project, err = runny.Load(ctx, r.Config.File, loadOpts)
+		}
+	}
 	if err != nil {
-		if r.Config.Debug {
-			fmt.Print(err, ", (tokens:", lex.TokenNames(lexer.Tokens), ")")
+		var tokenErr *runny.TokenError
+		if r.Config.Debug && errors.As(err, &tokenErr) {
+			fmt.Print(err, ", (tokens:", lex.TokenNames(tokenErr.Tokens), ")")
 		} else {
-			fmt.Print(err)
+			r.printError(err)
 		}
+		r.ExitCode = 1
 		return
 	}
 
-	// i think we can condense the scan & parse stages into one by using a channel
-	parser := parser.New()
-	statements, err := parser.Parse(tokens)
+	for _, warning := range project.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+
+	// test and check are built in, but a target with either name is always run instead
+	if _, isTarget := project.Target(r.Config.Target); !isTarget {
+		switch r.Config.Target {
+		case "test":
+			r.runTests(ctx, project, opts)
+			return
+		case "check":
+			r.check(project)
+			return
+		}
+	}
+
+	if r.Config.Vars {
+		variables, err := project.Variables(ctx, r.Config.Target, opts)
+		if err != nil {
+			r.printError(err)
+			r.ExitCode = 1
+			return
+		}
+		printVariables(variables)
+		return
+	}
+
+	result, err := project.Run(ctx, r.Config.Target, opts)
+	r.reportTimings(result.Timings)
 	if err != nil {
-		fmt.Print(err)
+		r.printError(err)
+		r.ExitCode = result.ExitCode
 		return
 	}
+}
+
+func (r *Runny) runWorkspace(ctx context.Context, ws *workspace.Workspace, opts workspace.Options) {
+	if r.Config.Target == "" {
+		r.printError(errors.New("--workspace needs a target to run"))
+		r.ExitCode = 1
+		return
+	}
+	results, err := ws.Run(ctx, r.Config.Target, opts)
+	timings := &runny.Timings{}
+	for _, result := range results {
+		timings.Add(result.Timings, result.Package.Dir)
+	}
+	r.reportTimings(timings)
+	if err != nil {
+		r.printError(err)
+		r.ExitCode = 1
+		for _, result := range results {
+			if result.Err != nil && result.ExitCode != 0 {
+				r.ExitCode = result.ExitCode
+				break
+			}
+		}
+	}
+}
 
-	interpreter := interpreter.New(r.Config.File, !r.Config.Testing)
-	if r.Config.Target != "" {
-		var err error
-		statements, err = interpreter.FilterStatementsByTarget(r.Config.Target, statements)
+// runs the file's test blocks, or those whose names contain the argument after test
+func (r *Runny) runTests(ctx context.Context, project *runny.Project, opts runny.Options) {
+	passed, failed := 0, 0
+	for _, test := range project.Tests {
+		if len(r.Config.Args) > 0 && !strings.Contains(test.Name, r.Config.Args[0]) {
+			continue
+		}
+		result, err := project.Test(ctx, test.Name, opts)
 		if err != nil {
-			fmt.Print(err)
+			r.printError(err)
+			r.ExitCode = 1
 			return
 		}
+		if result.Passed() {
+			passed++
+			fmt.Printf("PASS %s (%s)\n", result.Name, result.Duration.Round(time.Millisecond))
+			continue
+		}
+		failed++
+		fmt.Printf("FAIL %s (%s)\n", result.Name, result.Duration.Round(time.Millisecond))
+		for _, failure := range result.Failures {
+			fmt.Printf("    %s\n", failure)
+		}
+		if result.Err != nil {
+			fmt.Printf("    %s\n", strings.TrimSpace(result.Err.Error()))
+		}
+		if len(result.Output) > 0 && r.Config.Verbosity != runny.Verbose {
+			fmt.Println("    output:")
+			for _, line := range result.Output {
+				fmt.Printf("      %s\n", line)
+			}
+		}
+	}
+	if passed+failed == 0 && len(r.Config.Args) == 0 {
+		r.printError(errors.New("no tests found"))
+		r.ExitCode = 1
+		return
+	}
+	if passed+failed == 0 {
+		r.printError(fmt.Errorf("no tests match '%s'", r.Config.Args[0]))
+		r.ExitCode = 1
+		return
 	}
+	fmt.Printf("\n%d tests: %d passed, %d failed\n", passed+failed, passed, failed)
+	if failed > 0 {
+		r.ExitCode = 1
+	}
+}
+
+// prints the mistakes runny check finds, failing if there are any
+func (r *Runny) check(project *runny.Project) {
+	problems := project.Check()
+	for _, problem := range problems {
+		fmt.Printf("%s [%s]\n", problem, problem.Kind)
+	}
+	if len(problems) == 0 {
+		fmt.Println("no problems found")
+		return
+	}
+	fmt.Printf("\n%d problems found\n", len(problems))
+	r.ExitCode = 1
+}
+
+// written once the run has finished, whether it passed or not
+func (r *Runny) writeJUnit(junit *runny.JUnit) {
+	file, err := os.Create(r.Config.JUnit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not write junit report:", err)
+		return
+	}
+	defer file.Close()
+	if err := junit.WriteXML(file, filepath.Base(r.Config.File)); err != nil {
+		fmt.Fprintln(os.Stderr, "could not write junit report:", err)
+	}
+}
 
-	_, err = interpreter.Evaluate(statements)
+// written once the run has finished, including spans that were cut short by a failure
+func (r *Runny) writeTrace(tracer *trace.Tracer) {
+	file, err := os.Create(r.Config.Trace)
 	if err != nil {
-		fmt.Print(err)
+		fmt.Fprintln(os.Stderr, "could not write trace:", err)
+		return
+	}
+	defer file.Close()
+	write := tracer.WriteChrome
+	if r.Config.TraceFormat == "otlp" {
+		write = tracer.WriteOTLP
+	}
+	if err := write(file); err != nil {
+		fmt.Fprintln(os.Stderr, "could not write trace:", err)
+	}
+}
+
+// the number of actions listed in the timings summary
+const slowestActions = 5
+
+// prints a summary of how long the run took with --timings, or writes it to a file with --timings=json
+func (r *Runny) reportTimings(timings *runny.Timings) {
+	switch r.Config.Timings {
+	case "text":
+		fmt.Fprintln(os.Stderr)
+		timings.WriteSummary(os.Stderr, slowestActions)
+	case "json":
+		file, err := os.Create(r.Config.TimingsFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not write timings:", err)
+			return
+		}
+		defer file.Close()
+		if err := timings.WriteJSON(file); err != nil {
+			fmt.Fprintln(os.Stderr, "could not write timings:", err)
+		}
+	}
+}
+
+// lex, parse and runtime errors end in a newline, others don't
+func (r *Runny) printError(err error) {
+	message := err.Error()
+	if r.Config.Output == "json" {
+		r.handler.Handle(runny.Event{
+			Type:  runny.Failed,
+			Time:  time.Now(),
+			Error: strings.TrimSuffix(message, "\n"),
+		})
 		return
 	}
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	fmt.Print(message)
+}
+
+// scripts are highlighted in a terminal unless NO_COLOR is set, see https://no-color.org
+func useColour() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func printVariables(variables []runny.Variable) {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, variable := range variables {
+		var shown interface{} = variable.Value
+		if variable.Secret {
+			shown = runny.Mask
+		}
+		fmt.Fprintf(writer, "%s\t%v\t(%s)\n", variable.Name, shown, variable.Source)
+	}
+	writer.Flush()
 }
 
 type Config struct {
-	Target  string
-	File    string
-	Debug   bool
-	Testing bool
+	Target    string
+	Args      []string // positional arguments after the target e.g. the tests runny test runs
+	File      string
+	Debug     bool
+	Testing   bool
+	Vars      bool              // print variables rather than running
+	Set       map[string]string // variables set with --set name=value
+	Offline   bool              // only use cached remote extends
+	Workspace bool              // run the target in every package that defines it
+	Parallel  bool              // run workspace packages at the same time
+	Verbosity runny.Verbosity   // set by --quiet, --verbose or --silent
+	Output    string            // "text" or "json", set by --output
+	Timings   string            // "text" or "json" to report how long the run took, set by --timings
+	// where --timings=json writes to
+	TimingsFile string
+	// where --junit writes a report of the targets run, and whether actions are included
+	JUnit        string
+	JUnitActions bool
+	// where --trace writes spans of loading and running, and whether they're "chrome" trace events or "otlp" json
+	Trace       string
+	TraceFormat string
 }
 
 func main() {
-	target, fileFlag := parseArgs()
+	config, fileFlag, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fmt.Println("argument error:", err)
+		os.Exit(1)
+	}
+	config.Debug = os.Getenv("DEBUG") == "true"
 
 	runny := Runny{
-		Config: Config{
-			Target: target,
-			Debug:  os.Getenv("DEBUG") == "true",
-		},
+		Config: config,
 	}
 
 	file, err := configFile(fileFlag)
 	if err != nil {
 		fmt.Println("config error:", err)
-		return
+		os.Exit(1)
 	}
 	runny.Config.File = file
 
 	runny.Run()
+	os.Exit(runny.ExitCode)
 }
 
-func parseArgs() (string, string) {
-	var target string
-	var foundFlag bool
+func parseArgs(args []string) (Config, string, error) {
+	config := Config{
+		Set:         make(map[string]string),
+		Output:      "text",
+		TimingsFile: "runny-timings.json",
+		TraceFormat: "chrome",
+	}
 	var fileFlag string
-	for _, arg := range os.Args[1:] {
-		if strings.HasPrefix(arg, "-f") {
-			foundFlag = true
-		} else if !foundFlag && target == "" {
-			target = arg
-		} else if foundFlag && fileFlag == "" {
-			fileFlag = arg
-			foundFlag = false
+	for index := 0; index < len(args); index++ {
+		arg := args[index]
+		switch {
+		case arg == "--vars":
+			config.Vars = true
+		case arg == "--offline":
+			config.Offline = true
+		case arg == "--workspace":
+			config.Workspace = true
+		case arg == "--parallel":
+			config.Parallel = true
+		case arg == "--quiet" || arg == "-q":
+			config.Verbosity = runny.Quiet
+		case arg == "--verbose" || arg == "-v":
+			config.Verbosity = runny.Verbose
+		case arg == "--silent" || arg == "-s":
+			config.Verbosity = runny.Silent
+		case isFlag(arg, "--output"):
+			value, err := flagValue(args, &index, "--output")
+			if err != nil {
+				return config, "", err
+			}
+			if value != "text" && value != "json" {
+				return config, "", fmt.Errorf("--output expects text or json, got '%s'", value)
+			}
+			config.Output = value
+		case arg == "--timings":
+			config.Timings = "text"
+		case strings.HasPrefix(arg, "--timings="):
+			value := strings.TrimPrefix(arg, "--timings=")
+			if value != "text" && value != "json" {
+				return config, "", fmt.Errorf("--timings expects text or json, got '%s'", value)
+			}
+			config.Timings = value
+		case isFlag(arg, "--timings-file"):
+			value, err := flagValue(args, &index, "--timings-file")
+			if err != nil {
+				return config, "", err
+			}
+			config.TimingsFile = value
+		case arg == "--junit-actions":
+			config.JUnitActions = true
+		case isFlag(arg, "--junit"):
+			value, err := flagValue(args, &index, "--junit")
+			if err != nil {
+				return config, "", err
+			}
+			config.JUnit = value
+		case isFlag(arg, "--trace-format"):
+			value, err := flagValue(args, &index, "--trace-format")
+			if err != nil {
+				return config, "", err
+			}
+			if value != "chrome" && value != "otlp" {
+				return config, "", fmt.Errorf("--trace-format expects chrome or otlp, got '%s'", value)
+			}
+			config.TraceFormat = value
+		case isFlag(arg, "--trace"):
+			value, err := flagValue(args, &index, "--trace")
+			if err != nil {
+				return config, "", err
+			}
+			config.Trace = value
+		case isFlag(arg, "--set"):
+			value, err := flagValue(args, &index, "--set")
+			if err != nil {
+				return config, "", err
+			}
+			name, varValue, found := strings.Cut(value, "=")
+			if !found || name == "" {
+				return config, "", fmt.Errorf("--set expects name=value, got '%s'", value)
+			}
+			config.Set[name] = varValue
+		case strings.HasPrefix(arg, "-f"):
+			value, err := flagValue(args, &index, "-f")
+			if err != nil {
+				return config, "", err
+			}
+			fileFlag = value
+		case config.Target == "":
+			config.Target = arg
+		default:
+			config.Args = append(config.Args, arg)
 		}
 	}
 
-	if fileFlag == "" {
-		fileFlag = "runny.rny"
-	}
+	return config, fileFlag, nil
+}
+
+func isFlag(arg string, name string) bool {
+	return arg == name || strings.HasPrefix(arg, name+"=")
+}
 
-	return target, fileFlag
+// reads the value of a flag given either as "--flag=value" or "--flag value"
+func flagValue(args []string, index *int, name string) (string, error) {
+	if value, found := strings.CutPrefix(args[*index], name+"="); found {
+		return value, nil
+	}
+	if *index+1 >= len(args) {
+		return "", fmt.Errorf("%s expects a value", name)
+	}
+	*index++
+	return args[*index], nil
 }
 
+// finds the nearest runny.rny if no file is given
 func configFile(flag string) (string, error) {
+	if flag == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		return workspace.Find(wd)
+	}
 	path, err := filepath.Abs(flag)
 	if err != nil {
 		return "", err
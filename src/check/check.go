@@ -0,0 +1,537 @@
+// Package check finds mistakes in a loaded runny file without running anything,
+// like running a target that doesn't exist or defining a variable nothing uses.
+package check
+
+import (
+	"fmt"
+	"regexp"
+	"runny/src/token"
+	"runny/src/tree"
+	"sort"
+	"strings"
+)
+
+type Kind string
+
+const (
+	UndefinedTarget  Kind = "undefined-target"
+	DuplicateTarget  Kind = "duplicate-target"
+	UnusedVariable   Kind = "unused-variable"
+	ShadowedVariable Kind = "shadowed-variable"
+	UnknownConfig    Kind = "unknown-config"
+	UnreachableRun   Kind = "unreachable-run"
+	DependencyCycle  Kind = "dependency-cycle"
+)
+
+// Problem is a mistake found in a file
+type Problem struct {
+	Span    token.Span
+	Kind    Kind
+	Message string
+}
+
+// String describes the problem and where it is e.g. "runny.rny:3:5: target 'x' is not defined"
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Span, p.Message)
+}
+
+// the config that runny reads, anything else is likely a typo
+var knownConfig = map[string]bool{
+	"shell":       true,
+	"clear_env":   true,
+	"inherit_env": true,
+}
+
+// variables used in scripts e.g. $name, ${name} or ${#name}
+var scriptVariable = regexp.MustCompile(`\$\{?[#!]?([A-Za-z_][A-Za-z0-9_]*)`)
+
+// Check returns the problems in statements, and the files they extend and import,
+// ordered by where they are
+func Check(statements []tree.Statement) []Problem {
+	c := &checker{
+		used:    make(map[string]bool),
+		checked: make(map[string]bool),
+	}
+	c.findUses(statements)
+	root := c.namespace(statements)
+	c.checkNamespace(root)
+	c.checkOrder(root)
+
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		a, b := c.problems[i].Span, c.problems[j].Span
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Start.Offset < b.Start.Offset
+	})
+	return c.problems
+}
+
+type checker struct {
+	problems []Problem
+	used     map[string]bool // names used as variables anywhere
+	checked  map[string]bool // imported files that have been checked, by path
+}
+
+// a file along with the files it extends, whose names are all shared
+type namespace struct {
+	files   [][]tree.Statement // the file's own statements first
+	skipped []tree.Statement   // top-level runs of extended files
+	targets map[string]tree.TargetStatement
+	imports map[string]*namespace
+	vars    map[string]token.Token // top-level variables, by name
+}
+
+func (c *checker) namespace(statements []tree.Statement) *namespace {
+	ns := &namespace{
+		targets: make(map[string]tree.TargetStatement),
+		imports: make(map[string]*namespace),
+		vars:    make(map[string]token.Token),
+	}
+	ns.add(statements)
+	for _, file := range ns.files {
+		for _, statement := range file {
+			imported, isImport := statement.(tree.ImportStatement)
+			if !isImport || imported.File == nil {
+				continue
+			}
+			importedNs := c.namespace(imported.File.Statements)
+			importedNs.skipped = append(importedNs.skipped, imported.File.Skipped...)
+			ns.imports[imported.Alias.Text] = importedNs
+			if !c.checked[imported.File.Path] {
+				c.checked[imported.File.Path] = true
+				c.checkNamespace(importedNs)
+			}
+		}
+	}
+	return ns
+}
+
+// extended files are added after the files extending them, whose definitions are preferred
+func (ns *namespace) add(statements []tree.Statement) {
+	ns.files = append(ns.files, statements)
+	for _, statement := range statements {
+		switch typed := statement.(type) {
+		case tree.TargetStatement:
+			if _, defined := ns.targets[typed.Name.Text]; !defined {
+				ns.targets[typed.Name.Text] = typed
+			}
+		case tree.VariableStatement:
+			for _, variable := range typed.Items {
+				if _, defined := ns.vars[variable.Name.Text]; !defined {
+					ns.vars[variable.Name.Text] = variable.Name
+				}
+			}
+		}
+	}
+	for _, statement := range statements {
+		if extends, isExtends := statement.(tree.ExtendsStatement); isExtends {
+			for _, file := range extends.Files {
+				ns.skipped = append(ns.skipped, file.Skipped...)
+				ns.add(file.Statements)
+			}
+		}
+	}
+}
+
+func (c *checker) report(span token.Span, kind Kind, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{
+		Span:    span,
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (c *checker) checkNamespace(ns *namespace) {
+	for _, file := range ns.files {
+		c.checkDuplicates(file)
+		walk(file, func(statement tree.Statement) {
+			switch typed := statement.(type) {
+			case tree.ConfigStatement:
+				for _, config := range typed.Items {
+					if !knownConfig[config.Name.Text] {
+						c.report(config.Name.Span, UnknownConfig, "unknown config '%s'", config.Name.Text)
+					}
+				}
+			case tree.RunStatement:
+				if typed.Name != (token.Token{}) && !ns.defines(typed.Name.Text) {
+					c.report(typed.Name.Span, UndefinedTarget, "target '%s' is not defined", typed.Name.Text)
+				}
+			case tree.VariableStatement:
+				for _, variable := range typed.Items {
+					if !c.isUsed(variable.Name.Text) {
+						c.report(variable.Name.Span, UnusedVariable, "variable '%s' is never used", variable.Name.Text)
+					}
+				}
+			}
+		})
+	}
+	for _, skipped := range ns.skipped {
+		c.report(skipped.Where(), UnreachableRun, "run never runs, only the file runny was started with runs anything")
+	}
+	c.checkShadowing(ns)
+	c.checkCycles(ns)
+}
+
+// whether a target is defined in the namespace, or in an imported one e.g. ci.build
+func (ns *namespace) defines(name string) bool {
+	if _, defined := ns.targets[name]; defined {
+		return true
+	}
+	alias, target, found := strings.Cut(name, ".")
+	if !found {
+		return false
+	}
+	imported, isImported := ns.imports[alias]
+	if !isImported {
+		return false
+	}
+	_, defined := imported.targets[target]
+	return defined
+}
+
+// a target defined twice in the same file. Extended files can redefine targets on purpose.
+func (c *checker) checkDuplicates(statements []tree.Statement) {
+	defined := make(map[string]token.Token)
+	for _, statement := range statements {
+		target, isTarget := statement.(tree.TargetStatement)
+		if !isTarget {
+			continue
+		}
+		if previous, isDefined := defined[target.Name.Text]; isDefined {
+			c.report(target.Name.Span, DuplicateTarget, "target '%s' is already defined on line %d", target.Name.Text, previous.Line)
+			continue
+		}
+		defined[target.Name.Text] = target.Name
+	}
+}
+
+// a variable used anywhere, including list items and map keys exported as name_0 or name_key
+func (c *checker) isUsed(name string) bool {
+	if c.used[name] {
+		return true
+	}
+	for used := range c.used {
+		if strings.HasPrefix(used, name+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// records the names of every variable used, in expressions and in scripts
+func (c *checker) findUses(statements []tree.Statement) {
+	walk(statements, func(statement tree.Statement) {
+		switch typed := statement.(type) {
+		case tree.ActionStatement:
+			c.findScriptUses(typed.Body.Text)
+		case tree.MockStatement:
+			c.findScriptUses(typed.Body.Text)
+		case tree.ExpressionStatement:
+			c.findExpressionUses(typed.Expression)
+		case tree.IfStatement:
+			c.findExpressionUses(typed.Condition)
+		case tree.ForStatement:
+			c.findExpressionUses(typed.Iterable)
+		case tree.ExpectStatement:
+			c.findExpressionUses(typed.Expected)
+		case tree.ExtendsStatement:
+			for _, file := range typed.Files {
+				c.findUses(file.Statements)
+				c.findUses(file.Skipped)
+			}
+		case tree.ImportStatement:
+			if typed.File != nil {
+				c.findUses(typed.File.Statements)
+				c.findUses(typed.File.Skipped)
+			}
+		}
+	})
+}
+
+func (c *checker) findScriptUses(script string) {
+	for _, match := range scriptVariable.FindAllStringSubmatch(script, -1) {
+		c.used[match[1]] = true
+	}
+}
+
+func (c *checker) findExpressionUses(expression tree.Expression) {
+	switch typed := expression.(type) {
+	case tree.Reference:
+		c.used[typed.Name.Text] = true
+	case tree.List:
+		for _, item := range typed.Items {
+			c.findExpressionUses(item)
+		}
+	case tree.Map:
+		for _, item := range typed.Items {
+			c.findExpressionUses(item.Value)
+		}
+	case tree.Call:
+		for _, argument := range typed.Arguments {
+			c.findExpressionUses(argument)
+		}
+	}
+}
+
+// walk calls visit for each statement and every statement nested in it,
+// but not those in the files they extend or import
+func walk(statements []tree.Statement, visit func(tree.Statement)) {
+	for _, statement := range statements {
+		if statement == nil {
+			continue
+		}
+		visit(statement)
+		walk(children(statement), visit)
+	}
+}
+
+func children(statement tree.Statement) []tree.Statement {
+	switch typed := statement.(type) {
+	case tree.TargetStatement:
+		return typed.Body
+	case tree.RunStatement:
+		return typed.Body
+	case tree.IfStatement:
+		return append(append([]tree.Statement{}, typed.Then...), typed.Else...)
+	case tree.ForStatement:
+		return typed.Body
+	case tree.TestStatement:
+		return typed.Body
+	case tree.VariableStatement:
+		return initialisers(typed.Items)
+	case tree.EnvStatement:
+		return initialisers(typed.Items)
+	case tree.ConfigStatement:
+		nested := make([]tree.Statement, 0, len(typed.Items))
+		for _, config := range typed.Items {
+			nested = append(nested, config.Initialiser)
+		}
+		for _, env := range typed.Env {
+			nested = append(nested, env)
+		}
+		return nested
+	}
+	return nil
+}
+
+func initialisers(variables []tree.Variable) []tree.Statement {
+	nested := make([]tree.Statement, 0, len(variables))
+	for _, variable := range variables {
+		nested = append(nested, variable.Initialiser)
+	}
+	return nested
+}
+
+// top-level runs in the file runny was started with run straight away, so the targets
+// they run, and the targets those run, have to be defined above them
+func (c *checker) checkOrder(root *namespace) {
+	defined := make(map[string]bool)
+	var visit func(statements []tree.Statement)
+	visit = func(statements []tree.Statement) {
+		for _, statement := range statements {
+			switch typed := statement.(type) {
+			case tree.TargetStatement:
+				defined[typed.Name.Text] = true
+			case tree.ExtendsStatement:
+				for _, file := range typed.Files {
+					walk(file.Statements, func(statement tree.Statement) {
+						if target, isTarget := statement.(tree.TargetStatement); isTarget {
+							defined[target.Name.Text] = true
+						}
+					})
+				}
+			case tree.ImportStatement:
+				defined[typed.Alias.Text+"."] = true
+			case tree.IfStatement:
+				visit(typed.Then)
+				visit(typed.Else)
+			case tree.ForStatement:
+				visit(typed.Body)
+			case tree.RunStatement:
+				visit(typed.Body)
+				if typed.Name == (token.Token{}) || !root.defines(typed.Name.Text) {
+					continue
+				}
+				for _, name := range root.reachable(typed.Name.Text) {
+					if !defined[name] {
+						c.report(typed.Name.Span, UndefinedTarget, "target '%s' is run before it's defined", name)
+						break
+					}
+				}
+			}
+		}
+	}
+	visit(root.files[0])
+}
+
+// the targets running name runs, starting with name, and imports as their alias e.g. "ci."
+func (ns *namespace) reachable(name string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if !ns.defines(name) {
+			return
+		}
+		if alias, _, found := strings.Cut(name, "."); found {
+			name = alias + "."
+		}
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		names = append(names, name)
+		target, isTarget := ns.targets[name]
+		if !isTarget {
+			return
+		}
+		for _, run := range runs(target.Body) {
+			visit(run.Name.Text)
+		}
+	}
+	visit(name)
+	return names
+}
+
+// the named runs in statements, including nested ones
+func runs(statements []tree.Statement) []tree.RunStatement {
+	var named []tree.RunStatement
+	walk(statements, func(statement tree.Statement) {
+		if run, isRun := statement.(tree.RunStatement); isRun && run.Name != (token.Token{}) {
+			named = append(named, run)
+		}
+	})
+	return named
+}
+
+// variables declared in each block a variable could be looked up in, innermost last
+type scopes []map[string]token.Token
+
+func (s scopes) nested() scopes {
+	return append(append(scopes{}, s...), make(map[string]token.Token))
+}
+
+// a var block shadows a variable when it declares a name an enclosing block already has.
+// var blocks in named runs e.g. run build { var { os "darwin" } } aren't reported, as they
+// take precedence over the target's own when it runs, which is what they're for.
+func (c *checker) checkShadowing(ns *namespace) {
+	top := scopes{ns.vars}
+	for _, file := range ns.files {
+		for _, statement := range file {
+			if _, isVar := statement.(tree.VariableStatement); !isVar {
+				c.shadowing([]tree.Statement{statement}, top)
+			}
+		}
+	}
+}
+
+func (c *checker) shadowing(statements []tree.Statement, enclosing scopes) {
+	current := enclosing[len(enclosing)-1]
+	for _, statement := range statements {
+		switch typed := statement.(type) {
+		case tree.VariableStatement:
+			for _, variable := range typed.Items {
+				if previous, isShadowed := enclosing[:len(enclosing)-1].lookup(variable.Name.Text); isShadowed {
+					c.report(variable.Name.Span, ShadowedVariable, "variable '%s' shadows the one on %s",
+						variable.Name.Text, token.Location(previous.File, previous.Line))
+				}
+				current[variable.Name.Text] = variable.Name
+			}
+		case tree.TargetStatement:
+			c.shadowing(typed.Body, enclosing.nested())
+		case tree.TestStatement:
+			c.shadowing(typed.Body, enclosing.nested())
+		case tree.IfStatement:
+			c.shadowing(typed.Then, enclosing.nested())
+			c.shadowing(typed.Else, enclosing.nested())
+		case tree.ForStatement:
+			body := enclosing.nested()
+			body[len(body)-1][typed.Name.Text] = typed.Name
+			c.shadowing(typed.Body, body)
+		case tree.RunStatement:
+			if typed.Name == (token.Token{}) {
+				c.shadowing(typed.Body, enclosing.nested())
+				continue
+			}
+			for _, nested := range typed.Body {
+				if _, isVar := nested.(tree.VariableStatement); !isVar {
+					c.shadowing([]tree.Statement{nested}, enclosing.nested())
+				}
+			}
+		}
+	}
+}
+
+func (s scopes) lookup(name string) (token.Token, bool) {
+	for i := len(s) - 1; i >= 0; i-- {
+		if declared, isDeclared := s[i][name]; isDeclared {
+			return declared, true
+		}
+	}
+	return token.Token{}, false
+}
+
+// targets that run each other never finish
+func (c *checker) checkCycles(ns *namespace) {
+	names := make([]string, 0, len(ns.targets))
+	for name := range ns.targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	reported := make(map[string]bool)
+	var path []string
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		path = append(path, name)
+		for _, run := range runs(ns.targets[name].Body) {
+			next := run.Name.Text
+			if _, isTarget := ns.targets[next]; !isTarget {
+				continue
+			}
+			switch state[next] {
+			case unvisited:
+				visit(next)
+			case visiting:
+				cycle := cycleFrom(path, next)
+				if key := cycleKey(cycle); !reported[key] {
+					reported[key] = true
+					c.report(run.Name.Span, DependencyCycle, "targets run each other in a cycle: %s",
+						strings.Join(append(cycle, next), " -> "))
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+	}
+	for _, name := range names {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+}
+
+// the end of path from the target that starts the cycle
+func cycleFrom(path []string, start string) []string {
+	for i, name := range path {
+		if name == start {
+			return append([]string{}, path[i:]...)
+		}
+	}
+	return path
+}
+
+// the same cycle found from a different target is reported once
+func cycleKey(cycle []string) string {
+	sorted := append([]string{}, cycle...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, " ")
+}
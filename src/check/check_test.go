@@ -0,0 +1,162 @@
+package check
+
+import (
+	"context"
+	"runny/src/loader"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		problems []string
+		kinds    []Kind
+	}{
+		{
+			name: "no problems",
+			files: fstest.MapFS{"runny.rny": {Data: []byte(`
+config { shell "bash" }
+var { files ["a.go"], server { host "localhost" } }
+target build {
+    run { go build $files && echo "${server_host}" }
+}
+run build
+`)}},
+		},
+		{
+			name: "undefined target",
+			files: fstest.MapFS{"runny.rny": {Data: []byte(`
+target build {
+    run tset
+}
+`)}},
+			problems: []string{"runny.rny:3:9: target 'tset' is not defined"},
+			kinds:    []Kind{UndefinedTarget},
+		},
+		{
+			name: "target run before it's defined",
+			files: fstest.MapFS{"runny.rny": {Data: []byte(`
+target build { run test }
+run build
+target test { run { go test } }
+`)}},
+			problems: []string{"runny.rny:3:5: target 'test' is run before it's defined"},
+			kinds:    []Kind{UndefinedTarget},
+		},
+		{
+			name: "duplicate target",
+			files: fstest.MapFS{"runny.rny": {Data: []byte(`
+target build { run { go build } }
+target build { run { go build ./... } }
+`)}},
+			problems: []string{"runny.rny:3:8: target 'build' is already defined on line 2"},
+			kinds:    []Kind{DuplicateTarget},
+		},
+		{
+			name: "extended files can redefine targets",
+			files: fstest.MapFS{
+				"runny.rny": {Data: []byte(`
+extends { "base.rny" }
+target build { run { go build ./... } }
+`)},
+				"base.rny": {Data: []byte(`target build { run { go build } }`)},
+			},
+		},
+		{
+			name: "unused variable",
+			files: fstest.MapFS{"runny.rny": {Data: []byte(`
+var { name "Tim", unused "x" }
+run { echo "hello $name" }
+`)}},
+			problems: []string{"runny.rny:2:19: variable 'unused' is never used"},
+			kinds:    []Kind{UnusedVariable},
+		},
+		{
+			name: "shadowed variable",
+			files: fstest.MapFS{"runny.rny": {Data: []byte(`
+var { os "linux" }
+target build {
+    var { os "darwin" }
+    run { echo $os }
+}
+`)}},
+			problems: []string{"runny.rny:4:11: variable 'os' shadows the one on runny.rny:2"},
+			kinds:    []Kind{ShadowedVariable},
+		},
+		{
+			name: "runs can override a target's variables",
+			files: fstest.MapFS{"runny.rny": {Data: []byte(`
+target build {
+    var { os "linux" }
+    run { echo $os }
+}
+target cross {
+    run build { var { os "darwin" } }
+}
+`)}},
+		},
+		{
+			name:     "unknown config",
+			files:    fstest.MapFS{"runny.rny": {Data: []byte(`config { shel "bash" }`)}},
+			problems: []string{"runny.rny:1:10: unknown config 'shel'"},
+			kinds:    []Kind{UnknownConfig},
+		},
+		{
+			name: "unreachable run",
+			files: fstest.MapFS{
+				"runny.rny": {Data: []byte(`extends { "base.rny" }`)},
+				"base.rny":  {Data: []byte("\nrun { echo \"setup\" }")},
+			},
+			problems: []string{"base.rny:2:1: run never runs, only the file runny was started with runs anything"},
+			kinds:    []Kind{UnreachableRun},
+		},
+		{
+			name: "dependency cycle",
+			files: fstest.MapFS{"runny.rny": {Data: []byte(`
+target a { run b }
+target b { run c }
+target c { run a }
+`)}},
+			problems: []string{"runny.rny:4:16: targets run each other in a cycle: a -> b -> c -> a"},
+			kinds:    []Kind{DependencyCycle},
+		},
+		{
+			name: "imported targets",
+			files: fstest.MapFS{
+				"runny.rny": {Data: []byte(`
+import "ci.rny" as ci
+target release {
+    run ci.build
+    run ci.deploy
+}
+`)},
+				"ci.rny": {Data: []byte("\nconfig { sh \"bash\" }\ntarget build { run { go build } }")},
+			},
+			problems: []string{
+				"ci.rny:2:10: unknown config 'sh'",
+				"runny.rny:5:9: target 'ci.deploy' is not defined",
+			},
+			kinds: []Kind{UnknownConfig, UndefinedTarget},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statements, err := loader.New(tt.files, nil).Load(context.Background(), "runny.rny")
+			assert.NoError(t, err)
+
+			problems := Check(statements)
+			var messages []string
+			var kinds []Kind
+			for _, problem := range problems {
+				messages = append(messages, problem.String())
+				kinds = append(kinds, problem.Kind)
+			}
+			assert.Equal(t, tt.problems, messages)
+			assert.Equal(t, tt.kinds, kinds)
+		})
+	}
+}
@@ -2,20 +2,36 @@ package env
 
 import (
 	"fmt"
+	"strings"
 )
 
 func NewEnvironment(enclosing *Environment) *Environment {
 	depth := 0
+	source := SourceFile
 	if enclosing != nil {
 		depth = enclosing.Depth + 1
+		source = SourceTarget
 	}
 	return &Environment{
 		Values:    NewValues(),
 		Enclosing: enclosing,
 		Depth:     depth,
+		Source:    source,
 	}
 }
 
+// NewNamespace creates an outermost environment that shares e's overrides,
+// so variables set from outside runny apply to imported files too
+func NewNamespace(e *Environment) *Environment {
+	namespace := NewEnvironment(nil)
+	root := e.root()
+	if root.Overrides == nil {
+		root.Overrides = make(map[string]Override)
+	}
+	namespace.Overrides = root.Overrides
+	return namespace
+}
+
 type ValueType int
 
 func (vt ValueType) String() string {
@@ -24,6 +40,10 @@ func (vt ValueType) String() string {
 		return "variable"
 	case VTTarget:
 		return "target"
+	case VTImport:
+		return "import"
+	case VTEnv:
+		return "environment variable"
 	}
 	return "unknown"
 }
@@ -32,83 +52,276 @@ const (
 	VTUnknown ValueType = iota
 	VTVar
 	VTTarget
+	VTImport
+	VTEnv // exported to commands exactly as defined, unlike variables
+)
+
+// Source is where a variable was defined. Sources are ordered by precedence,
+// so a variable from a higher source is never replaced by a lower one.
+type Source int
+
+const (
+	SourceUnknown Source = iota
+	SourceExtends
+	SourceFile
+	SourceTarget
+	SourceRun // blocks in a run of a target, which override the target's own
+	SourceEnvironment
+	SourceCLI
+	SourceLoop // loop variables, which only exist inside the loop
 )
 
+func (s Source) String() string {
+	switch s {
+	case SourceExtends:
+		return "extends"
+	case SourceFile:
+		return "file"
+	case SourceTarget:
+		return "target"
+	case SourceRun:
+		return "run"
+	case SourceEnvironment:
+		return "environment"
+	case SourceCLI:
+		return "cli"
+	case SourceLoop:
+		return "loop"
+	}
+	return "unknown"
+}
+
+// process environment variables with this prefix override runny variables
+// e.g. RUNNY_VAR_name=tim
+const EnvironmentPrefix = "RUNNY_VAR_"
+
+// FromEnviron returns the variable overrides found in a list of "key=value" pairs
+func FromEnviron(environ []string) map[string]string {
+	overrides := make(map[string]string)
+	for _, pair := range environ {
+		if !strings.HasPrefix(pair, EnvironmentPrefix) {
+			continue
+		}
+		name, value, found := strings.Cut(strings.TrimPrefix(pair, EnvironmentPrefix), "=")
+		if found && name != "" {
+			overrides[name] = value
+		}
+	}
+	return overrides
+}
+
 type Values struct {
-	Vars    map[string]interface{}
-	Targets map[string]interface{}
+	Vars          map[string]interface{}
+	Targets       map[string]interface{}
+	Imports       map[string]interface{}
+	Env           map[string]interface{}
+	Secrets       map[string]bool
+	Sources       map[string]Source
+	TargetSources map[string]Source
+	EnvSources    map[string]Source
 }
 
 func NewValues() Values {
 	return Values{
-		Vars:    make(map[string]interface{}),
-		Targets: map[string]interface{}{},
+		Vars:          make(map[string]interface{}),
+		Targets:       map[string]interface{}{},
+		Imports:       make(map[string]interface{}),
+		Env:           make(map[string]interface{}),
+		Secrets:       make(map[string]bool),
+		Sources:       make(map[string]Source),
+		TargetSources: make(map[string]Source),
+		EnvSources:    make(map[string]Source),
 	}
 }
 
+type Override struct {
+	Value  interface{}
+	Source Source
+}
+
 type Environment struct {
 	Values    Values
+	Overrides map[string]Override // only read from the outermost environment
 	Enclosing *Environment
 	Depth     int
+	Source    Source // the source of variables defined in this environment
 }
 
 func (e *Environment) Define(name string, valueType ValueType, value interface{}) {
 	if len(name) > 0 {
 		switch valueType {
 		case VTVar:
+			// a var declared in a loop replaces the loop variable
+			if existing, ok := e.Values.Sources[name]; ok && existing > e.Source && existing != SourceLoop {
+				return
+			}
 			e.Values.Vars[name] = value
+			e.Values.Sources[name] = e.Source
 		case VTTarget:
+			if existing, ok := e.Values.TargetSources[name]; ok && existing > e.Source {
+				return
+			}
 			e.Values.Targets[name] = value
+			e.Values.TargetSources[name] = e.Source
+		case VTImport:
+			e.Values.Imports[name] = value
+		case VTEnv:
+			if existing, ok := e.Values.EnvSources[name]; ok && existing > e.Source {
+				return
+			}
+			e.Values.Env[name] = value
+			e.Values.EnvSources[name] = e.Source
 		}
 	}
 }
 
+// Bind defines a loop variable, which overrides can't replace
+func (e *Environment) Bind(name string, value interface{}) {
+	e.Values.Vars[name] = value
+	e.Values.Sources[name] = SourceLoop
+}
+
+// Override sets a variable that takes precedence over every definition in the scope chain
+// except loop variables
+func (e *Environment) Override(name string, value interface{}, source Source) {
+	root := e.root()
+	if root.Overrides == nil {
+		root.Overrides = make(map[string]Override)
+	}
+	if existing, ok := root.Overrides[name]; ok && existing.Source > source {
+		return
+	}
+	root.Overrides[name] = Override{
+		Value:  value,
+		Source: source,
+	}
+}
+
 func (e *Environment) Get(name string, valueType ValueType) (interface{}, error) {
 	switch valueType {
 	case VTVar:
-		if val, ok := e.Values.Vars[name]; ok {
-			return val, nil
+		if override, ok := e.override(name); ok {
+			return override.Value, nil
 		}
+		return e.get(name, valueType)
+	case VTTarget, VTImport, VTEnv:
+		return e.get(name, valueType)
+	}
+	return nil, fmt.Errorf("undefined %s '%s'", valueType, name)
+}
 
-		if e.Enclosing != nil {
-			return e.Enclosing.Get(name, VTVar)
+func (e *Environment) get(name string, valueType ValueType) (interface{}, error) {
+	switch valueType {
+	case VTVar:
+		if val, ok := e.Values.Vars[name]; ok {
+			return val, nil
 		}
 	case VTTarget:
 		if val, ok := e.Values.Targets[name]; ok {
 			return val, nil
 		}
-
-		if e.Enclosing != nil {
-			return e.Enclosing.Get(name, VTTarget)
+	case VTImport:
+		if val, ok := e.Values.Imports[name]; ok {
+			return val, nil
 		}
+	case VTEnv:
+		if val, ok := e.Values.Env[name]; ok {
+			return val, nil
+		}
+	}
+	if e.Enclosing != nil {
+		return e.Enclosing.get(name, valueType)
 	}
 	return nil, fmt.Errorf("undefined %s '%s'", valueType, name)
 }
 
+// Secret marks a variable as secret in this scope
+func (e *Environment) Secret(name string) {
+	e.Values.Secrets[name] = true
+}
+
+// IsSecret reports whether a variable was declared secret anywhere in the scope chain.
+// overrides of a secret variable are secret too.
+func (e *Environment) IsSecret(name string) bool {
+	for scope := e; scope != nil; scope = scope.Enclosing {
+		if scope.Values.Secrets[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSource returns where the effective value of a variable comes from
+func (e *Environment) GetSource(name string) Source {
+	if override, ok := e.override(name); ok {
+		return override.Source
+	}
+	for scope := e; scope != nil; scope = scope.Enclosing {
+		if source, ok := scope.Values.Sources[name]; ok {
+			return source
+		}
+	}
+	return SourceUnknown
+}
+
+// GetAll merges the scope chain into a new map. Inner scopes are preferred to
+// outer ones and overrides are preferred to both.
 func (e *Environment) GetAll(valueType ValueType) map[string]interface{} {
+	all := e.getAll(valueType)
+	if valueType == VTVar {
+		for k := range e.root().Overrides {
+			if override, ok := e.override(k); ok {
+				all[k] = override.Value
+			}
+		}
+	}
+	return all
+}
+
+func (e *Environment) getAll(valueType ValueType) map[string]interface{} {
+	all := make(map[string]interface{})
+	if e.Enclosing != nil {
+		all = e.Enclosing.getAll(valueType)
+	}
 	switch valueType {
 	case VTVar:
-		vars := e.Values.Vars
-		if e.Enclosing != nil {
-			for k, v := range e.Enclosing.GetAll(VTVar) {
-				// local variable is preferred to global
-				if _, exists := vars[k]; !exists {
-					vars[k] = v
-				}
-			}
+		for k, v := range e.Values.Vars {
+			all[k] = v
 		}
-		return vars
 	case VTTarget:
-		targets := e.Values.Targets
-		if e.Enclosing != nil {
-			for k, v := range e.Enclosing.GetAll(VTTarget) {
-				// local variable is preferred to global
-				if _, exists := targets[k]; !exists {
-					targets[k] = v
-				}
-			}
+		for k, v := range e.Values.Targets {
+			all[k] = v
+		}
+	case VTImport:
+		for k, v := range e.Values.Imports {
+			all[k] = v
 		}
-		return targets
+	case VTEnv:
+		for k, v := range e.Values.Env {
+			all[k] = v
+		}
+	}
+	return all
+}
+
+// the override of a variable, unless the nearest definition of it comes from a higher source
+func (e *Environment) override(name string) (Override, bool) {
+	override, ok := e.root().Overrides[name]
+	if !ok {
+		return Override{}, false
+	}
+	for scope := e; scope != nil; scope = scope.Enclosing {
+		if source, ok := scope.Values.Sources[name]; ok {
+			return override, override.Source >= source
+		}
+	}
+	return override, true
+}
+
+func (e *Environment) root() *Environment {
+	root := e
+	for root.Enclosing != nil {
+		root = root.Enclosing
 	}
-	return make(map[string]interface{}, 0)
+	return root
 }
@@ -0,0 +1,138 @@
+package env
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironment_Define(t *testing.T) {
+	t.Run("extended variables do not replace file variables", func(t *testing.T) {
+		e := NewEnvironment(nil)
+		e.Define("name", VTVar, "file")
+		e.Source = SourceExtends
+		e.Define("name", VTVar, "extends")
+		e.Define("other", VTVar, "extends")
+
+		name, _ := e.Get("name", VTVar)
+		assert.Equal(t, "file", name)
+		assert.Equal(t, SourceFile, e.GetSource("name"))
+		assert.Equal(t, SourceExtends, e.GetSource("other"))
+	})
+	t.Run("file variables replace extended variables", func(t *testing.T) {
+		e := NewEnvironment(nil)
+		e.Source = SourceExtends
+		e.Define("name", VTVar, "extends")
+		e.Source = SourceFile
+		e.Define("name", VTVar, "file")
+
+		name, _ := e.Get("name", VTVar)
+		assert.Equal(t, "file", name)
+	})
+	t.Run("extended targets do not replace file targets", func(t *testing.T) {
+		e := NewEnvironment(nil)
+		e.Define("build", VTTarget, "file")
+		e.Source = SourceExtends
+		e.Define("build", VTTarget, "extends")
+
+		build, _ := e.Get("build", VTTarget)
+		assert.Equal(t, "file", build)
+	})
+}
+
+func TestEnvironment_Override(t *testing.T) {
+	t.Run("overrides are preferred to local variables", func(t *testing.T) {
+		global := NewEnvironment(nil)
+		global.Define("name", VTVar, "file")
+		local := NewEnvironment(global)
+		local.Define("name", VTVar, "target")
+		local.Override("name", "env", SourceEnvironment)
+
+		name, _ := local.Get("name", VTVar)
+		assert.Equal(t, "env", name)
+		assert.Equal(t, "env", local.GetAll(VTVar)["name"])
+		assert.Equal(t, SourceEnvironment, local.GetSource("name"))
+	})
+	t.Run("loop variables are preferred to overrides", func(t *testing.T) {
+		global := NewEnvironment(nil)
+		global.Define("file", VTVar, "file")
+		loop := NewEnvironment(global)
+		loop.Bind("file", "a.go")
+		body := NewEnvironment(loop)
+		body.Override("file", "cli", SourceCLI)
+
+		file, _ := body.Get("file", VTVar)
+		assert.Equal(t, "a.go", file)
+		assert.Equal(t, "a.go", body.GetAll(VTVar)["file"])
+		assert.Equal(t, SourceLoop, body.GetSource("file"))
+		file, _ = global.Get("file", VTVar)
+		assert.Equal(t, "cli", file)
+	})
+	t.Run("cli overrides are preferred to environment overrides", func(t *testing.T) {
+		e := NewEnvironment(nil)
+		e.Override("name", "cli", SourceCLI)
+		e.Override("name", "env", SourceEnvironment)
+
+		name, _ := e.Get("name", VTVar)
+		assert.Equal(t, "cli", name)
+		assert.Equal(t, SourceCLI, e.GetSource("name"))
+	})
+}
+
+func TestNewNamespace(t *testing.T) {
+	e := NewEnvironment(nil)
+	e.Define("name", VTVar, "file")
+	namespace := NewNamespace(e)
+	e.Override("version", "cli", SourceCLI)
+
+	_, err := namespace.Get("name", VTVar)
+	assert.Error(t, err)
+	version, _ := namespace.Get("version", VTVar)
+	assert.Equal(t, "cli", version)
+}
+
+func TestEnvironment_GetAll(t *testing.T) {
+	t.Run("local variables are preferred to global", func(t *testing.T) {
+		global := NewEnvironment(nil)
+		global.Define("name", VTVar, "global")
+		global.Define("other", VTVar, "global")
+		local := NewEnvironment(global)
+		local.Define("name", VTVar, "local")
+
+		assert.Equal(t, map[string]interface{}{
+			"name":  "local",
+			"other": "global",
+		}, local.GetAll(VTVar))
+	})
+	t.Run("merging does not modify the local scope", func(t *testing.T) {
+		global := NewEnvironment(nil)
+		global.Define("other", VTVar, "global")
+		local := NewEnvironment(global)
+		local.Define("name", VTVar, "local")
+		local.GetAll(VTVar)
+
+		assert.Equal(t, map[string]interface{}{"name": "local"}, local.Values.Vars)
+	})
+}
+
+func TestFromEnviron(t *testing.T) {
+	overrides := FromEnviron([]string{
+		"HOME=/home/tim",
+		"RUNNY_VAR_name=tim",
+		"RUNNY_VAR_empty=",
+		"RUNNY_VAR_=nothing",
+	})
+	assert.Equal(t, map[string]string{"name": "tim", "empty": ""}, overrides)
+}
+
+func TestEnvironment_Secret(t *testing.T) {
+	global := NewEnvironment(nil)
+	global.Define("token", VTVar, "abc")
+	global.Secret("token")
+	local := NewEnvironment(global)
+	local.Define("name", VTVar, "tim")
+
+	assert.True(t, local.IsSecret("token"))
+	assert.False(t, local.IsSecret("name"))
+	assert.False(t, NewNamespace(local).IsSecret("token"))
+}
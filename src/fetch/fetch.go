@@ -0,0 +1,242 @@
+// Package fetch downloads remote runny files into a local cache.
+//
+// Two kinds of source are supported:
+//
+//	https://example.com/ci/base.rny
+//	git+https://github.com/org/repo.git//ci/base.rny@v1.0.0
+//
+// Fetched files are pinned by content hash in a lock file so that a
+// source can't silently change between runs.
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+func New(cacheDir string, lock *Lock) *Fetcher {
+	return &Fetcher{
+		CacheDir: cacheDir,
+		Lock:     lock,
+		sources:  make(map[string]string),
+	}
+}
+
+type Fetcher struct {
+	CacheDir string
+	Offline  bool // only use files that are already cached
+	// allow plain http sources, which can be changed in transit before they're pinned
+	AllowHTTP bool
+	Lock      *Lock
+	Client    *http.Client // http.DefaultClient if nil
+	mutex     sync.Mutex
+	sources   map[string]string // cached file path -> source
+}
+
+// DefaultCacheDir is where fetched files are kept unless told otherwise
+func DefaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "runny")
+}
+
+func IsRemote(source string) bool {
+	return strings.HasPrefix(source, "git+") ||
+		strings.HasPrefix(source, "https://") ||
+		strings.HasPrefix(source, "http://")
+}
+
+// Resolve finds a path relative to a remote source e.g. a file extended by a remote file
+func Resolve(base string, relative string) string {
+	if IsRemote(relative) {
+		return relative
+	}
+	if strings.HasPrefix(base, "git+") {
+		repo, file, ref, err := parseGit(base)
+		if err != nil {
+			return relative
+		}
+		resolved := repo + "//" + path.Join(path.Dir(file), relative)
+		if ref != "" {
+			resolved += "@" + ref
+		}
+		return resolved
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return relative
+	}
+	relativeURL, err := url.Parse(relative)
+	if err != nil {
+		return relative
+	}
+	return baseURL.ResolveReference(relativeURL).String()
+}
+
+// Source returns the source a cached file was fetched from
+func (f *Fetcher) Source(file string) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	source, ok := f.sources[file]
+	return source, ok
+}
+
+// Fetch returns the path of a cached copy of source, downloading it if necessary
+func (f *Fetcher) Fetch(ctx context.Context, source string) (string, error) {
+	if strings.HasPrefix(source, "http://") && !f.AllowHTTP {
+		return "", fmt.Errorf("could not fetch %s: remote files must use https", source)
+	}
+
+	if sum, locked := f.Lock.Sum(source); locked {
+		file := f.cachePath(sum)
+		if contents, err := os.ReadFile(file); err == nil && hash(contents) == sum {
+			f.remember(file, source)
+			return file, nil
+		}
+	}
+
+	if f.Offline {
+		return "", fmt.Errorf("%s is not cached and runny is offline", source)
+	}
+
+	contents, err := f.download(ctx, source)
+	if err != nil {
+		return "", fmt.Errorf("could not fetch %s: %s", source, err)
+	}
+
+	sum := hash(contents)
+	if locked, ok := f.Lock.Sum(source); ok && locked != sum {
+		return "", fmt.Errorf("%s has changed: expected %s in lock file, got %s", source, locked, sum)
+	}
+
+	file := f.cachePath(sum)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(file, contents, 0644); err != nil {
+		return "", err
+	}
+	if err := f.Lock.Add(source, sum); err != nil {
+		return "", err
+	}
+	f.remember(file, source)
+	return file, nil
+}
+
+func (f *Fetcher) remember(file string, source string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.sources[file] = source
+}
+
+// files are stored by their hash so unchanged files are shared between sources
+func (f *Fetcher) cachePath(sum string) string {
+	return filepath.Join(f.CacheDir, "files", strings.TrimPrefix(sum, "sha256:")+".rny")
+}
+
+func (f *Fetcher) download(ctx context.Context, source string) ([]byte, error) {
+	if strings.HasPrefix(source, "git+") {
+		return f.downloadGit(ctx, source)
+	}
+	return f.downloadHTTP(ctx, source)
+}
+
+func (f *Fetcher) downloadHTTP(ctx context.Context, source string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return io.ReadAll(response.Body)
+}
+
+// fetches the ref into a bare repository in the cache and reads the file from it
+func (f *Fetcher) downloadGit(ctx context.Context, source string) ([]byte, error) {
+	repo, file, ref, err := parseGit(source)
+	if err != nil {
+		return nil, err
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+	remote := strings.TrimPrefix(repo, "git+")
+	// git would read these as options e.g. --upload-pack=<command>
+	if strings.HasPrefix(remote, "-") || strings.HasPrefix(ref, "-") {
+		return nil, fmt.Errorf("invalid git source %s", source)
+	}
+
+	repoDir := filepath.Join(f.CacheDir, "git", strings.TrimPrefix(hash([]byte(remote)), "sha256:")[:16])
+	if _, err := os.Stat(repoDir); os.IsNotExist(err) {
+		if _, err := git(ctx, "", "init", "--quiet", "--bare", "--", repoDir); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := git(ctx, repoDir, "fetch", "--quiet", "--", remote, ref); err != nil {
+		return nil, err
+	}
+	return git(ctx, repoDir, "show", "FETCH_HEAD:"+file)
+}
+
+func git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// splits git+<repo>//<file>@<ref> into its parts
+func parseGit(source string) (repo string, file string, ref string, err error) {
+	schemeEnd := strings.Index(source, "://")
+	if schemeEnd < 0 {
+		return "", "", "", fmt.Errorf("invalid git source %s", source)
+	}
+	schemeEnd += len("://")
+	separator := strings.Index(source[schemeEnd:], "//")
+	if separator < 0 {
+		return "", "", "", fmt.Errorf("git source %s has no file, expected repo//path/to/file.rny", source)
+	}
+	repo = source[:schemeEnd+separator]
+	file = source[schemeEnd+separator+len("//"):]
+	if at := strings.LastIndex(file, "@"); at >= 0 {
+		file, ref = file[:at], file[at+1:]
+	}
+	return repo, file, ref, nil
+}
+
+func hash(contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
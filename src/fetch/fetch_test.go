@@ -0,0 +1,156 @@
+package fetch
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolve(t *testing.T) {
+	assert.Equal(t, "https://example.com/ci/common.rny", Resolve("https://example.com/ci/base.rny", "common.rny"))
+	assert.Equal(t, "https://example.com/common.rny", Resolve("https://example.com/ci/base.rny", "../common.rny"))
+	assert.Equal(
+		t,
+		"git+https://example.com/repo.git//ci/common.rny@v1",
+		Resolve("git+https://example.com/repo.git//ci/base.rny@v1", "common.rny"),
+	)
+	assert.Equal(t, "https://other.com/a.rny", Resolve("https://example.com/ci/base.rny", "https://other.com/a.rny"))
+}
+
+func TestParseGit(t *testing.T) {
+	repo, file, ref, err := parseGit("git+ssh://git@github.com/org/repo.git//ci/base.rny@v1.0.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "git+ssh://git@github.com/org/repo.git", repo)
+	assert.Equal(t, "ci/base.rny", file)
+	assert.Equal(t, "v1.0.0", ref)
+
+	_, _, _, err = parseGit("git+https://github.com/org/repo.git")
+	assert.Error(t, err)
+}
+
+func TestFetcher_HTTP(t *testing.T) {
+	contents := "target remote { run { echo remote } }"
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/base.rny" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(contents))
+	}))
+	defer server.Close()
+	source := server.URL + "/base.rny"
+
+	dir := t.TempDir()
+	lock, err := ReadLock(filepath.Join(dir, "runny.lock"))
+	assert.NoError(t, err)
+	fetcher := New(filepath.Join(dir, "cache"), lock)
+	fetcher.Client = server.Client()
+
+	t.Run("files are cached and pinned", func(t *testing.T) {
+		file, err := fetcher.Fetch(context.Background(), source)
+		assert.NoError(t, err)
+		cached, _ := os.ReadFile(file)
+		assert.Equal(t, contents, string(cached))
+		fetchedFrom, ok := fetcher.Source(file)
+		assert.True(t, ok)
+		assert.Equal(t, source, fetchedFrom)
+
+		saved, err := ReadLock(lock.Path)
+		assert.NoError(t, err)
+		sum, ok := saved.Sum(source)
+		assert.True(t, ok)
+		assert.Equal(t, hash([]byte(contents)), sum)
+	})
+	t.Run("offline fetches use the cache", func(t *testing.T) {
+		offline := New(fetcher.CacheDir, lock)
+		offline.Offline = true
+		_, err := offline.Fetch(context.Background(), source)
+		assert.NoError(t, err)
+	})
+	t.Run("offline fetches fail if not cached", func(t *testing.T) {
+		offline := New(t.TempDir(), lock)
+		offline.Offline = true
+		_, err := offline.Fetch(context.Background(), source)
+		assert.ErrorContains(t, err, "is not cached and runny is offline")
+	})
+	t.Run("changed files don't match the lock", func(t *testing.T) {
+		contents = "target changed { run { echo changed } }"
+		changed := New(t.TempDir(), lock)
+		changed.Client = server.Client()
+		_, err := changed.Fetch(context.Background(), source)
+		assert.ErrorContains(t, err, "has changed")
+	})
+	t.Run("missing files", func(t *testing.T) {
+		_, err := fetcher.Fetch(context.Background(), server.URL+"/missing.rny")
+		assert.ErrorContains(t, err, "404")
+	})
+	t.Run("http needs allowing", func(t *testing.T) {
+		plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(contents))
+		}))
+		defer plain.Close()
+
+		insecure := New(t.TempDir(), &Lock{})
+		_, err := insecure.Fetch(context.Background(), plain.URL+"/base.rny")
+		assert.ErrorContains(t, err, "remote files must use https")
+
+		insecure.AllowHTTP = true
+		_, err = insecure.Fetch(context.Background(), plain.URL+"/base.rny")
+		assert.NoError(t, err)
+	})
+}
+
+func TestFetcher_Git(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	repo := t.TempDir()
+	runGit := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repo
+		cmd.Env = append(os.Environ(),
+			"GIT_AUTHOR_NAME=runny", "GIT_AUTHOR_EMAIL=runny@example.com",
+			"GIT_COMMITTER_NAME=runny", "GIT_COMMITTER_EMAIL=runny@example.com",
+		)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s", args, output)
+		}
+	}
+	runGit("init", "--quiet", "--initial-branch=main")
+	assert.NoError(t, os.MkdirAll(filepath.Join(repo, "ci"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(repo, "ci", "base.rny"), []byte("target v1 {}"), 0644))
+	runGit("add", ".")
+	runGit("commit", "--quiet", "-m", "v1")
+	runGit("tag", "v1")
+	assert.NoError(t, os.WriteFile(filepath.Join(repo, "ci", "base.rny"), []byte("target v2 {}"), 0644))
+	runGit("commit", "--quiet", "-am", "v2")
+
+	fetcher := New(t.TempDir(), &Lock{})
+	for ref, want := range map[string]string{"v1": "target v1 {}", "main": "target v2 {}"} {
+		file, err := fetcher.Fetch(context.Background(), "git+file://"+repo+"//ci/base.rny@"+ref)
+		assert.NoError(t, err)
+		contents, _ := os.ReadFile(file)
+		assert.Equal(t, want, string(contents))
+	}
+
+	_, err := fetcher.Fetch(context.Background(), "git+file://"+repo+"//ci/missing.rny@v1")
+	assert.Error(t, err)
+
+	// sources that git would read as options are never run
+	marker := filepath.Join(t.TempDir(), "ran")
+	for _, source := range []string{
+		"git+--upload-pack=touch " + marker + "://x//ci/base.rny",
+		"git+file://" + repo + "//ci/base.rny@--upload-pack=touch " + marker,
+	} {
+		_, err = fetcher.Fetch(context.Background(), source)
+		assert.ErrorContains(t, err, "invalid git source")
+	}
+	assert.NoFileExists(t, marker)
+}
@@ -0,0 +1,96 @@
+package fetch
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const lockHeader = "# generated by runny, pins the contents of remote extends\n"
+
+// Lock maps remote sources to the hash of their contents. It's saved
+// whenever a new source is added.
+type Lock struct {
+	Path  string // not saved if empty
+	sums  map[string]string
+	mutex sync.Mutex
+}
+
+// ReadLock reads a lock file, or returns an empty lock if it doesn't exist yet
+func ReadLock(path string) (*Lock, error) {
+	lock := &Lock{
+		Path: path,
+		sums: make(map[string]string),
+	}
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "sha256:") {
+			return nil, fmt.Errorf("%s:%d: expected '<source> sha256:<hash>'", path, line)
+		}
+		lock.sums[fields[0]] = fields[1]
+	}
+	return lock, nil
+}
+
+func (l *Lock) Sum(source string) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	sum, ok := l.sums[source]
+	return sum, ok
+}
+
+// Add pins a source to a hash and saves the lock file
+func (l *Lock) Add(source string, sum string) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.sums == nil {
+		l.sums = make(map[string]string)
+	}
+	if l.sums[source] == sum {
+		return nil
+	}
+	l.sums[source] = sum
+	return l.save()
+}
+
+func (l *Lock) save() error {
+	if l.Path == "" {
+		return nil
+	}
+	sources := make([]string, 0, len(l.sums))
+	for source := range l.sums {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	var builder strings.Builder
+	builder.WriteString(lockHeader)
+	for _, source := range sources {
+		fmt.Fprintf(&builder, "%s %s\n", source, l.sums[source])
+	}
+	return os.WriteFile(l.Path, []byte(builder.String()), 0644)
+}
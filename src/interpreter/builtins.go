@@ -0,0 +1,215 @@
+package interpreter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runny/src/value"
+	"runtime"
+	"strings"
+)
+
+type Builtin struct {
+	MinArgs int
+	MaxArgs int // -1 if there's no limit
+	Call    func(i *Interpreter, arguments []value.Value) (value.Value, error)
+}
+
+func (b Builtin) checkArity(count int) error {
+	if count < b.MinArgs || (b.MaxArgs >= 0 && count > b.MaxArgs) {
+		expected := fmt.Sprintf("%d", b.MinArgs)
+		if b.MaxArgs < 0 {
+			expected = fmt.Sprintf("at least %d", b.MinArgs)
+		} else if b.MaxArgs != b.MinArgs {
+			expected = fmt.Sprintf("%d to %d", b.MinArgs, b.MaxArgs)
+		}
+		return fmt.Errorf("expects %s argument(s), got %d", expected, count)
+	}
+	return nil
+}
+
+// functions that can be called from var and config expressions e.g. env("HOME")
+var builtins = map[string]Builtin{
+	"env": {
+		MinArgs: 1,
+		MaxArgs: 1,
+		Call: func(i *Interpreter, arguments []value.Value) (value.Value, error) {
+			return value.String(i.getenv(arguments[0].String())), nil
+		},
+	},
+	"os": {
+		Call: func(i *Interpreter, arguments []value.Value) (value.Value, error) {
+			return value.String(runtime.GOOS), nil
+		},
+	},
+	"arch": {
+		Call: func(i *Interpreter, arguments []value.Value) (value.Value, error) {
+			return value.String(runtime.GOARCH), nil
+		},
+	},
+	"join": {
+		MinArgs: 1,
+		MaxArgs: -1,
+		Call: func(i *Interpreter, arguments []value.Value) (value.Value, error) {
+			parts := make([]string, 0, len(arguments))
+			for _, argument := range arguments {
+				parts = append(parts, argument.String())
+			}
+			return value.String(filepath.Join(parts...)), nil
+		},
+	},
+	"glob": {
+		MinArgs: 1,
+		MaxArgs: 1,
+		Call: func(i *Interpreter, arguments []value.Value) (value.Value, error) {
+			return i.glob(arguments[0].String())
+		},
+	},
+	"read_file": {
+		MinArgs: 1,
+		MaxArgs: 1,
+		Call: func(i *Interpreter, arguments []value.Value) (value.Value, error) {
+			contents, err := i.readFile(i.path(arguments[0].String()))
+			if err != nil {
+				return nil, err
+			}
+			// trailing newlines are trimmed like the output of a var's run block
+			return value.String(strings.TrimRight(string(contents), "\n")), nil
+		},
+	},
+	"sha256": {
+		MinArgs: 1,
+		MaxArgs: 1,
+		Call: func(i *Interpreter, arguments []value.Value) (value.Value, error) {
+			contents, err := i.readFile(i.path(arguments[0].String()))
+			if err != nil {
+				return nil, err
+			}
+			sum := sha256.Sum256(contents)
+			return value.String(hex.EncodeToString(sum[:])), nil
+		},
+	},
+	"uppercase": {
+		MinArgs: 1,
+		MaxArgs: 1,
+		Call: func(i *Interpreter, arguments []value.Value) (value.Value, error) {
+			return value.String(strings.ToUpper(arguments[0].String())), nil
+		},
+	},
+	"default": {
+		MinArgs: 2,
+		MaxArgs: -1,
+		Call: func(i *Interpreter, arguments []value.Value) (value.Value, error) {
+			// the first argument that isn't empty
+			for _, argument := range arguments {
+				if argument != nil && argument.String() != "" {
+					return argument, nil
+				}
+			}
+			return arguments[len(arguments)-1], nil
+		},
+	},
+	"git_branch": {
+		Call: func(i *Interpreter, arguments []value.Value) (value.Value, error) {
+			branch, err := gitBranch(filepath.Dir(i.Origin))
+			if err != nil {
+				return nil, err
+			}
+			return value.String(branch), nil
+		},
+	},
+}
+
+// relative paths are relative to the file being read
+func (i *Interpreter) path(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(i.Origin), path)
+}
+
+// relative patterns are matched from the directory of the file being read. Their
+// matches are relative to the directory commands run in, so scripts can use them,
+// or absolute if they're outside it.
+func (i *Interpreter) glob(pattern string) (value.List, error) {
+	if i.FS != nil {
+		return i.globFS(pattern)
+	}
+	matches, err := filepath.Glob(i.path(pattern))
+	if err != nil {
+		return nil, err
+	}
+	dir, err := filepath.Abs(i.Dir)
+	if err != nil {
+		return nil, err
+	}
+	list := make(value.List, 0, len(matches))
+	for _, match := range matches {
+		if !filepath.IsAbs(pattern) {
+			if match, err = filepath.Abs(match); err != nil {
+				return nil, err
+			}
+			if relative, err := filepath.Rel(dir, match); err == nil && filepath.IsLocal(relative) {
+				match = relative
+			}
+		}
+		list = append(list, value.String(match))
+	}
+	return list, nil
+}
+
+// files read from an fs.FS have no directory on disk, so matches stay relative to
+// the file being read
+func (i *Interpreter) globFS(pattern string) (value.List, error) {
+	matches, err := fs.Glob(i.FS, filepath.ToSlash(filepath.Clean(i.path(pattern))))
+	if err != nil {
+		return nil, err
+	}
+	list := make(value.List, 0, len(matches))
+	for _, match := range matches {
+		if !filepath.IsAbs(pattern) {
+			if relative, err := filepath.Rel(filepath.Dir(i.Origin), match); err == nil {
+				match = relative
+			}
+		}
+		list = append(list, value.String(match))
+	}
+	return list, nil
+}
+
+// reads the current branch from .git/HEAD in dir or the nearest parent directory.
+// a detached HEAD returns the commit hash instead.
+func gitBranch(dir string) (string, error) {
+	for {
+		gitPath := filepath.Join(dir, ".git")
+		info, err := os.Stat(gitPath)
+		if err == nil {
+			if !info.IsDir() {
+				// worktrees and submodules point to the real git directory
+				contents, err := os.ReadFile(gitPath)
+				if err != nil {
+					return "", err
+				}
+				gitDir := strings.TrimSpace(strings.TrimPrefix(string(contents), "gitdir:"))
+				if !filepath.IsAbs(gitDir) {
+					gitDir = filepath.Join(dir, gitDir)
+				}
+				gitPath = gitDir
+			}
+			head, err := os.ReadFile(filepath.Join(gitPath, "HEAD"))
+			if err != nil {
+				return "", err
+			}
+			ref := strings.TrimSpace(string(head))
+			return strings.TrimPrefix(ref, "ref: refs/heads/"), nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("not a git repository")
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,186 @@
+package interpreter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventType string
+
+const (
+	TargetStarted  EventType = "target_started"
+	TargetFinished EventType = "target_finished"
+	ActionStarted  EventType = "action_started"
+	ActionFinished EventType = "action_finished"
+	Output         EventType = "output"      // a line written by a command
+	Description    EventType = "description" // a line of a target's desc block
+	Failed         EventType = "error"       // runny couldn't load or run a file
+)
+
+// Event is something that happened during a run. Which fields are set depends on its type.
+type Event struct {
+	Type      EventType
+	Time      time.Time
+	ID        uint64 // the start of the target or action the event is about, shared by its output and finish
+	TargetID  uint64 // the ID of the target the event is in, if any
+	Package   string // the workspace package, if running across a workspace
+	Target    string
+	File      string
+	Line      int
+	Script    string   // the script an action runs
+	Env       []string // the "name=value" pairs an action is run with, besides the inherited environment
+	Silent    bool     // the action is in a run:silent block
+	Stream    string   // "stdout" or "stderr" for output
+	Text      string   // a line of output or description
+	ExitCode  int
+	Duration  time.Duration
+	Error     string
+	Cancelled bool // the target was stopped by a cancellation rather than failing
+}
+
+// tells apart starts of the same target or action, which can run at the same time in a parallel loop
+var ids atomic.Uint64
+
+func nextID() uint64 {
+	return ids.Add(1)
+}
+
+// Handler receives the events of a run. Iterations of a parallel loop send
+// events at the same time, so handlers must be safe to call concurrently.
+type Handler interface {
+	Handle(event Event)
+}
+
+// TextHandler prints events for people to read
+type TextHandler struct {
+	Out       io.Writer // os.Stdout if nil
+	Err       io.Writer // os.Stderr if nil
+	Verbosity Verbosity
+	Colour    bool // highlight printed scripts
+	mutex     sync.Mutex
+}
+
+const (
+	foreColour = "\033[32m"
+	aftColour  = "\033[0m"
+)
+
+func (h *TextHandler) Handle(event Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	out, err := orStdout(h.Out), orStderr(h.Err)
+	switch event.Type {
+	case Description:
+		if h.Verbosity.printsScripts() {
+			fmt.Fprintf(out, "> %s\n", event.Text)
+		}
+	case ActionStarted:
+		if event.Silent || !h.Verbosity.printsScripts() {
+			return
+		}
+		script := event.Script
+		if h.Colour {
+			script = foreColour + script + aftColour
+		}
+		fmt.Fprintln(out, script)
+		if h.Verbosity == Verbose {
+			for _, pair := range event.Env {
+				fmt.Fprintf(out, "  %s\n", pair)
+			}
+		}
+	case ActionFinished:
+		if h.Verbosity == Verbose {
+			fmt.Fprintf(out, "took %s\n", event.Duration.Round(time.Millisecond))
+		}
+	case Output:
+		if event.Stream == "stderr" {
+			fmt.Fprintln(err, event.Text)
+		} else if h.Verbosity != Silent {
+			fmt.Fprintln(out, event.Text)
+		}
+	}
+}
+
+// JSONHandler writes each event as a line of JSON
+type JSONHandler struct {
+	encoder *json.Encoder
+	mutex   sync.Mutex
+}
+
+func NewJSONHandler(out io.Writer) *JSONHandler {
+	encoder := json.NewEncoder(out)
+	// scripts are full of > and &
+	encoder.SetEscapeHTML(false)
+	return &JSONHandler{
+		encoder: encoder,
+	}
+}
+
+type jsonEvent struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	Package    string    `json:"package,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	File       string    `json:"file,omitempty"`
+	Line       int       `json:"line,omitempty"`
+	Script     string    `json:"script,omitempty"`
+	Env        []string  `json:"env,omitempty"`
+	Silent     bool      `json:"silent,omitempty"`
+	Stream     string    `json:"stream,omitempty"`
+	Text       *string   `json:"text,omitempty"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	DurationMs *int64    `json:"duration_ms,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Cancelled  bool      `json:"cancelled,omitempty"`
+}
+
+func (h *JSONHandler) Handle(event Event) {
+	encoded := jsonEvent{
+		Type:      event.Type,
+		Time:      event.Time,
+		Package:   event.Package,
+		Target:    event.Target,
+		File:      event.File,
+		Line:      event.Line,
+		Script:    event.Script,
+		Env:       event.Env,
+		Silent:    event.Silent,
+		Stream:    event.Stream,
+		Error:     event.Error,
+		Cancelled: event.Cancelled,
+	}
+	switch event.Type {
+	case Output, Description:
+		// empty lines are still lines
+		encoded.Text = &event.Text
+	case ActionFinished, TargetFinished:
+		durationMs := event.Duration.Milliseconds()
+		encoded.ExitCode = &event.ExitCode
+		encoded.DurationMs = &durationMs
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.encoder.Encode(encoded)
+}
+
+// redacts secrets from an event before it's handled
+func (p *Printer) redact(event Event) Event {
+	if !p.Redactor.Active() {
+		return event
+	}
+	event.Script = p.Redactor.Redact(event.Script)
+	event.Text = p.Redactor.Redact(event.Text)
+	event.Error = p.Redactor.Redact(event.Error)
+	if event.Env != nil {
+		env := make([]string, len(event.Env))
+		for index, pair := range event.Env {
+			env[index] = p.Redactor.Redact(pair)
+		}
+		event.Env = env
+	}
+	return event
+}
@@ -0,0 +1,112 @@
+package interpreter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"runny/src/lex"
+	"runny/src/parser"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// go test ./src/interpreter -update rewrites the golden files from what's printed
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestGolden lexes, parses and runs each testdata/*.rny file, comparing what it prints
+// to name.out, its errors to name.err and its exit code to name.exit. Missing files
+// are expected to be empty, or 0 for the exit code.
+func TestGolden(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "*.rny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no fixtures found in testdata")
+	}
+	for _, fixture := range fixtures {
+		name := strings.TrimSuffix(filepath.Base(fixture), ".rny")
+		t.Run(name, func(t *testing.T) {
+			stdout, stderr, exitCode := runFixture(t, fixture)
+			golden := strings.TrimSuffix(fixture, ".rny")
+			exit := ""
+			if exitCode != 0 {
+				exit = strconv.Itoa(exitCode) + "\n"
+			}
+			if *update {
+				writeGolden(t, golden+".out", stdout)
+				writeGolden(t, golden+".err", stderr)
+				writeGolden(t, golden+".exit", exit)
+				return
+			}
+			assert.Equal(t, readGolden(t, golden+".out"), stdout, "stdout")
+			assert.Equal(t, readGolden(t, golden+".err"), stderr, "stderr")
+			assert.Equal(t, readGolden(t, golden+".exit"), exit, "exit code")
+		})
+	}
+}
+
+// runs a fixture the way runny would, with errors written after anything printed to stderr
+func runFixture(t *testing.T, fixture string) (string, string, int) {
+	contents, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	fail := func(err error) (string, string, int) {
+		stderr.WriteString(err.Error())
+		var runtimeErr *RuntimeError
+		if errors.As(err, &runtimeErr) && runtimeErr.ExitCode != 0 {
+			return stdout.String(), stderr.String(), runtimeErr.ExitCode
+		}
+		return stdout.String(), stderr.String(), 1
+	}
+
+	lexer := lex.New()
+	lexer.File = filepath.Base(fixture)
+	lexer.Input = string(contents)
+	statements, err := parser.New().ParseSource(lexer)
+	if err != nil {
+		return fail(err)
+	}
+
+	i := New(fixture, true)
+	i.Printer.Out = &stdout
+	i.Printer.Err = &stderr
+	i.Dir = t.TempDir()
+	i.Env = []string{"PATH=" + os.Getenv("PATH")}
+	if _, err := i.Evaluate(context.Background(), statements); err != nil {
+		return fail(err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+func readGolden(t *testing.T, path string) string {
+	contents, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+// empty golden files are removed rather than written
+func writeGolden(t *testing.T, path string, contents string) {
+	if contents == "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		return
+	}
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,38 +1,41 @@
 package interpreter
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runny/src/env"
-	"runny/src/lex"
-	"runny/src/parser"
+	"runny/src/fetch"
 	"runny/src/token"
+	"runny/src/trace"
 	"runny/src/tree"
+	"runny/src/value"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 func New(origin string, printOutput bool) *Interpreter {
 	return &Interpreter{
-		Config:      make(map[string]interface{}, 0),
+		Config:      make(map[string]value.Value, 0),
 		Environment: env.NewEnvironment(nil),
 		Origin:      origin,
-		Printer:     &Printer{},
+		Printer:     &Printer{Redactor: NewRedactor()},
 		PrintOutput: printOutput,
+		ctx:         context.Background(),
 	}
 }
 
-type Config map[string]interface{}
+type Config map[string]value.Value
 
 func (c Config) getShell() string {
-	shell, ok := c["shell"]
-	if ok {
-		trimmedShell := trimQuotes(shell)
-		if shellStr, ok := trimmedShell.(string); ok {
-			return shellStr
-		}
+	if shell, ok := c["shell"]; ok && shell != nil {
+		return shell.String()
 	}
 	return "sh"
 }
@@ -44,18 +47,24 @@ type Interpreter struct {
 	Environment *env.Environment
 	PrintOutput bool
 	Printer     *Printer
+	Env         []string       // the environment commands start with, os.Environ() if nil
+	Dir         string         // the directory commands run in, the current directory if empty
+	FS          fs.FS          // where files are read from, the os filesystem if nil
+	Fetcher     *fetch.Fetcher // where remote files loaded by the loader came from
+	silent      bool           // inside a run:silent block
+	target      string         // the target being run, if any
+	targetID    uint64         // the ID of the target's start events
+	namespace   string         // the alias of the import this interpreter runs, if any
+	test        *testState     // the test being run, if any
+	ctx         context.Context
 }
 
-func (i *Interpreter) Evaluate(statements []tree.Statement) (result []interface{}, err error) {
+// Evaluate runs statements until they finish or ctx is cancelled
+func (i *Interpreter) Evaluate(ctx context.Context, statements []tree.Statement) (result []interface{}, err error) {
+	i.ctx = ctx
 	defer func() {
 		if r := recover(); r != nil {
-			if str, ok := r.(string); ok {
-				err = fmt.Errorf(str)
-			} else if e, ok := r.(error); ok {
-				err = e
-			} else {
-				err = fmt.Errorf("unknown panic: %v", r)
-			}
+			err = i.recovered(r)
 		}
 	}()
 	i.Statements = statements
@@ -68,21 +77,36 @@ func (i *Interpreter) Evaluate(statements []tree.Statement) (result []interface{
 	return
 }
 
+// the error for a panic that stopped Evaluate or ResolveVariables
+func (i *Interpreter) recovered(r interface{}) error {
+	var err error
+	if i.ctx.Err() != nil {
+		// commands killed by a cancellation fail with unhelpful errors
+		err = i.cancelled()
+	} else if str, ok := r.(string); ok {
+		err = errors.New(str)
+	} else if e, ok := r.(error); ok {
+		err = e
+	} else {
+		err = fmt.Errorf("unknown panic: %v", r)
+	}
+	return i.redactError(err)
+}
+
 func (i *Interpreter) FilterStatementsByTarget(targetStr string, statements []tree.Statement) ([]tree.Statement, error) {
-	var foundTarget *tree.TargetStatement
+	foundTarget := findTarget(targetStr, statements)
 	filteredStatements := make([]tree.Statement, 0)
 	for _, statement := range statements {
 		if _, isRun := statement.(tree.RunStatement); isRun {
 			continue
 		}
-		if target, isTarget := statement.(tree.TargetStatement); isTarget {
-			if target.Name.Text == targetStr {
-				foundTarget = &target
-			}
-		}
 		filteredStatements = append(filteredStatements, statement)
 	}
 	if foundTarget == nil {
+		// imported targets are run as ci:build
+		if name, isImported := importedTarget(targetStr, statements); isImported {
+			return append(filteredStatements, tree.RunStatement{Name: name}), nil
+		}
 		return nil, fmt.Errorf("target '%s' does not exist", targetStr)
 	}
 	filteredStatements = append(filteredStatements, tree.RunStatement{
@@ -91,13 +115,118 @@ func (i *Interpreter) FilterStatementsByTarget(targetStr string, statements []tr
 	return filteredStatements, nil
 }
 
+// finds a target defined in statements or the files they extend
+func findTarget(targetStr string, statements []tree.Statement) *tree.TargetStatement {
+	var found *tree.TargetStatement
+	for _, statement := range statements {
+		switch typed := statement.(type) {
+		case tree.TargetStatement:
+			if typed.Name.Text == targetStr {
+				// the extending file's target is preferred
+				return &typed
+			}
+		case tree.ExtendsStatement:
+			for _, file := range typed.Files {
+				if target := findTarget(targetStr, file.Statements); target != nil {
+					found = target
+				}
+			}
+		}
+	}
+	return found
+}
+
+// converts ci:build to the name of a run statement if ci is imported
+func importedTarget(targetStr string, statements []tree.Statement) (token.Token, bool) {
+	alias, _, found := strings.Cut(targetStr, ":")
+	if !found {
+		return token.Token{}, false
+	}
+	for _, statement := range statements {
+		if imported, isImport := statement.(tree.ImportStatement); isImport && imported.Alias.Text == alias {
+			return token.Token{
+				Type: token.IDENTIFIER,
+				Text: strings.ReplaceAll(targetStr, ":", "."),
+			}, true
+		}
+	}
+	return token.Token{}, false
+}
+
+type ResolvedVariable struct {
+	Name   string
+	Value  value.Value
+	Source env.Source
+	Secret bool
+}
+
+// ResolveVariables evaluates every variable visible to a target (or the top
+// level if no target is given) without running anything
+func (i *Interpreter) ResolveVariables(ctx context.Context, targetStr string, statements []tree.Statement) (resolved []ResolvedVariable, err error) {
+	i.ctx = ctx
+	defer func() {
+		if r := recover(); r != nil {
+			err = i.recovered(r)
+		}
+	}()
+	for _, statement := range statements {
+		if _, isRun := statement.(tree.RunStatement); isRun {
+			continue
+		}
+		i.Accept(statement)
+	}
+	if name, isImported := importedTarget(targetStr, statements); isImported {
+		targetStr = name.Text
+	}
+	return i.resolveVariables(targetStr)
+}
+
+func (i *Interpreter) resolveVariables(targetStr string) (resolved []ResolvedVariable, err error) {
+	if namespace, name, isImported := i.lookupImport(targetStr); isImported {
+		return namespace.resolveVariables(name)
+	}
+	if targetStr != "" {
+		targetBodyInt, err := i.Environment.Get(targetStr, env.VTTarget)
+		if err != nil {
+			return nil, fmt.Errorf("target '%s' does not exist", targetStr)
+		}
+		i.Environment = env.NewEnvironment(i.Environment)
+		if targetBody, ok := targetBodyInt.([]tree.Statement); ok {
+			for _, statement := range targetBody {
+				if variables, isVar := statement.(tree.VariableStatement); isVar {
+					i.Accept(variables)
+				}
+			}
+		}
+	}
+	for name := range i.Environment.GetAll(env.VTVar) {
+		variable, err := i.lookupVariable(name)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, ResolvedVariable{
+			Name:   name,
+			Value:  variable,
+			Source: i.Environment.GetSource(name),
+			Secret: i.Environment.IsSecret(name),
+		})
+	}
+	sort.Slice(resolved, func(a, b int) bool {
+		return resolved[a].Name < resolved[b].Name
+	})
+	return resolved, nil
+}
+
 func (i *Interpreter) Accept(statement tree.Statement) interface{} {
 	return statement.Accept(i)
 }
 
 func (i *Interpreter) VisitConfigStatement(statement tree.ConfigStatement) interface{} {
 	for _, config := range statement.Items {
-		i.Config[config.Name.Text] = i.Accept(config.Initialiser)
+		i.Config[config.Name.Text] = i.evaluate(config.Initialiser)
+	}
+	for _, env := range statement.Env {
+		i.Accept(env)
 	}
 	return nil
 }
@@ -105,6 +234,9 @@ func (i *Interpreter) VisitConfigStatement(statement tree.ConfigStatement) inter
 func (i *Interpreter) VisitVariableStatement(statement tree.VariableStatement) interface{} {
 	for _, variable := range statement.Items {
 		i.Environment.Define(variable.Name.Text, env.VTVar, variable.Initialiser)
+		if statement.Secret {
+			i.Environment.Secret(variable.Name.Text)
+		}
 	}
 	return nil
 }
@@ -121,6 +253,9 @@ func (i *Interpreter) VisitTargetStatement(statement tree.TargetStatement) inter
 
 func orderValue(statement tree.Statement) int {
 	switch statementTyped := statement.(type) {
+	case tree.EnvStatement:
+		// applies to the whole target
+		return 0
 	case tree.RunStatement:
 		switch statementTyped.Stage {
 		case tree.BEFORE:
@@ -134,22 +269,39 @@ func orderValue(statement tree.Statement) int {
 	return 2
 }
 
-const (
-	foreColour = "\033[32m"
-	aftColour  = "\033[0m"
-)
-
 func (i *Interpreter) VisitActionStatement(statement tree.ActionStatement) interface{} {
-	evaluated := make(map[string]interface{}, 0)
+	i.checkCancelled()
+
+	evaluated := make(map[string]value.Value, 0)
 	for k := range i.Environment.GetAll(env.VTVar) {
 		variable, _ := i.lookupVariable(k)
 		evaluated[k] = variable
 	}
+	environment := i.environmentVariables()
+
+	started := Event{
+		Type:     ActionStarted,
+		Time:     time.Now(),
+		ID:       nextID(),
+		TargetID: i.targetID,
+		Target:   i.target,
+		File:     statement.Body.File,
+		Line:     statement.Body.Line,
+		Script:   statement.Body.Text,
+		Env:      exported(evaluated, environment),
+		Silent:   i.silent,
+	}
+	i.emit(started)
+	_, span := trace.Start(i.ctx, "action", fmt.Sprintf("%s:%d", started.File, started.Line), "script", i.Printer.Redactor.Redact(started.Script))
+	defer func() {
+		finishSpan(span, recover())
+	}()
 
-	// print command string (highlighted)
-	i.Printer.PushStr(fmt.Sprintf("%s%s%s\n", foreColour, relativeDedent(statement.Body.Text), aftColour))
-
-	cmd := createCommand(statement.Body.Text, evaluated, i.Config.getShell())
+	cmd := i.createCommand(statement.Body.Text, evaluated, environment)
+	source := newSourceMap(i.Config.getShell(), statement.Body)
+	if i.PrintOutput {
+		cmd.Stderr = i.Printer.stderr(started, source)
+	}
 
 	// creates a pipe to stdout that can be scanned by printer instance
 	cmdOut, err := cmd.StdoutPipe()
@@ -158,54 +310,73 @@ func (i *Interpreter) VisitActionStatement(statement tree.ActionStatement) inter
 	}
 
 	i.Printer.Push(Statement{
-		Cmd:    cmd, // cmd included here so printer can wait
-		StdOut: cmdOut,
+		Cmd:     cmd, // cmd included here so printer can wait
+		StdOut:  cmdOut,
+		Started: started,
+		source:  source,
 	})
 
 	if err := cmd.Start(); err != nil {
 		panic(i.error(fmt.Sprintf("could not run command: %s", err.Error())))
 	}
 
+	// wait for the command before running anything else, so later actions, and
+	// the if conditions and loops between them, see what it did, and a failed command
+	// stops the run before anything after it starts. Interpreters that don't
+	// print wait when they finish instead.
+	if i.PrintOutput {
+		i.Printer.Print()
+	}
+
 	return nil
 }
 
-func relativeDedent(inputString string) string {
-	lines := strings.Split(inputString, "\n")
-	if len(lines) > 1 {
-		lowestPositiveIndent := 0
-		for _, line := range lines {
-			whitespace := countLeadingSpaces(line)
-			if lowestPositiveIndent <= 0 {
-				lowestPositiveIndent = whitespace
-				continue
-			}
-			if whitespace < lowestPositiveIndent && whitespace != 0 {
-				lowestPositiveIndent = whitespace
-			}
-		}
-		for i, line := range lines {
-			if i == 0 {
-				continue
-			}
-			lines[i] = line[lowestPositiveIndent:]
-		}
-		return strings.Join(lines, "\n")
+// events aren't sent when commands are started without waiting for them
+func (i *Interpreter) emit(event Event) {
+	if i.PrintOutput {
+		i.Printer.Emit(event)
 	}
-	return inputString
 }
 
-func countLeadingSpaces(line string) int {
-	return len(line) - len(strings.TrimLeft(line, " "))
+// the "name=value" pairs a command is run with, besides the inherited environment
+func exported(variables map[string]value.Value, environment []string) []string {
+	names := make([]string, 0, len(variables))
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, len(names)+len(environment))
+	for _, name := range names {
+		if variables[name] != nil {
+			pairs = append(pairs, value.Export(name, variables[name])...)
+		}
+	}
+	return append(pairs, environment...)
 }
 
 func (i *Interpreter) VisitRunStatement(statement tree.RunStatement) interface{} {
-	startEnvironment := i.Environment
+	startEnvironment, startSilent, startTarget, startTargetID, startCtx := i.Environment, i.silent, i.target, i.targetID, i.ctx
 	i.Environment = env.NewEnvironment(i.Environment)
+	i.silent = i.silent || statement.Silent
 	defer func() {
-		i.Environment = startEnvironment
+		i.Environment, i.silent, i.target, i.targetID, i.ctx = startEnvironment, startSilent, startTarget, startTargetID, startCtx
 	}()
 
 	body := statement.Body
+	own := len(body) // the run's own statements, before any of its target's
+
+	if namespace, name, isImported := i.lookupImport(statement.Name.Text); isImported {
+		for _, statement := range body {
+			i.checkCancelled()
+			i.Accept(statement)
+		}
+		// imported targets run with their own file's variables
+		namespace.silent = i.silent
+		namespace.VisitRunStatement(tree.RunStatement{
+			Name: token.Token{Type: token.IDENTIFIER, Text: name, Line: statement.Name.Line},
+		})
+		return nil
+	}
 
 	if statement.Name != (token.Token{}) {
 		targetBodyInt, err := i.Environment.Get(statement.Name.Text, env.VTTarget)
@@ -216,39 +387,288 @@ func (i *Interpreter) VisitRunStatement(statement tree.RunStatement) interface{}
 			// append contents of target onto end of body
 			body = append(body, targetBody...)
 		}
+		i.target = statement.Name.Text
+		i.targetID = nextID()
+		if i.namespace != "" {
+			i.target = i.namespace + ":" + i.target
+		}
+		// actions and imported targets are traced inside the target
+		var span *trace.Span
+		i.ctx, span = trace.Start(i.ctx, "target", i.target, "file", statement.Name.File)
+		defer func() {
+			finishSpan(span, recover())
+		}()
+		defer i.targetFinished(statement.Name, i.startTarget(statement.Name))
+		// variables and env set by the run override the target's own
+		i.Environment.Source = env.SourceRun
 	}
 
-	for _, statement := range body {
+	for index, statement := range body {
+		i.checkCancelled()
+		if index == own {
+			i.Environment.Source = env.SourceTarget
+		}
 		i.Accept(statement)
 	}
 
 	return nil
 }
 
+// ends a span, failing it if it ended with a panic, which carries on up
+func finishSpan(span *trace.Span, r interface{}) {
+	if err, ok := r.(error); ok {
+		span.Fail(err)
+	} else if r != nil {
+		span.Fail(fmt.Errorf("%v", r))
+	}
+	span.Finish()
+	if r != nil {
+		panic(r)
+	}
+}
+
+func (i *Interpreter) startTarget(name token.Token) time.Time {
+	start := time.Now()
+	i.emit(Event{
+		Type:     TargetStarted,
+		Time:     start,
+		ID:       i.targetID,
+		TargetID: i.targetID,
+		Target:   i.target,
+		File:     name.File,
+		Line:     name.Line,
+	})
+	return start
+}
+
+// deferred so a failing target is reported before the failure carries on up
+func (i *Interpreter) targetFinished(name token.Token, start time.Time) {
+	finished := Event{
+		Type:     TargetFinished,
+		ID:       i.targetID,
+		TargetID: i.targetID,
+		Target:   i.target,
+		File:     name.File,
+		Line:     name.Line,
+		Duration: time.Since(start),
+	}
+	r := recover()
+	if r != nil {
+		finished.ExitCode = 1
+		finished.Cancelled = i.ctx.Err() != nil
+		var runtimeErr *RuntimeError
+		if err, ok := r.(error); ok {
+			finished.Error = strings.TrimSuffix(err.Error(), "\n")
+			if errors.As(err, &runtimeErr) && runtimeErr.ExitCode != 0 {
+				finished.ExitCode = runtimeErr.ExitCode
+			}
+		} else {
+			finished.Error = fmt.Sprint(r)
+		}
+	}
+	i.emit(finished)
+	if r != nil {
+		panic(r)
+	}
+}
+
 func (i *Interpreter) VisitDescribeStatement(statement tree.DescribeStatement) interface{} {
 	for _, line := range statement.Lines {
-		i.Printer.PushStr(fmt.Sprintf("> %s\n", trimQuotes(line.Value)))
+		i.emit(Event{
+			Type:   Description,
+			Target: i.target,
+			Text:   fmt.Sprint(line.Value),
+		})
 	}
 	return nil
 }
 
 func (i *Interpreter) VisitExtendsStatement(statement tree.ExtendsStatement) interface{} {
-	for _, path := range statement.Paths {
-		evaluatedPath := path.Accept(i)
-		evaluatedPath = trimQuotes(evaluatedPath)
-		if pathStr, isString := evaluatedPath.(string); isString {
-			path := filepath.Join(filepath.Dir(i.Origin), pathStr)
-			err := i.Extend(path)
-			if err != nil {
-				panic(i.error(err.Error()))
-			}
-		} else {
-			panic(i.error(fmt.Sprintf("extends path %v is not a string", evaluatedPath)))
+	if len(statement.Files) != len(statement.Paths) {
+		panic(i.error("extended files have not been loaded"))
+	}
+
+	// variables in extended files never replace those in the extending file
+	startSource, startOrigin := i.Environment.Source, i.Origin
+	i.Environment.Source = env.SourceExtends
+	defer func() {
+		i.Environment.Source, i.Origin = startSource, startOrigin
+	}()
+
+	for _, file := range statement.Files {
+		i.Origin = file.Path
+		for _, statement := range file.Statements {
+			i.Accept(statement)
 		}
 	}
 	return nil
 }
 
+func (i *Interpreter) VisitImportStatement(statement tree.ImportStatement) interface{} {
+	if statement.File == nil {
+		panic(i.error("imported file has not been loaded"))
+	}
+	alias := statement.Alias.Text
+	if _, err := i.Environment.Get(alias, env.VTImport); err == nil {
+		panic(i.error(fmt.Sprintf("import '%s' is already defined", alias)))
+	}
+
+	namespace := &Interpreter{
+		Config:      make(map[string]value.Value),
+		Origin:      statement.File.Path,
+		Environment: env.NewNamespace(i.Environment),
+		Printer:     i.Printer,
+		PrintOutput: i.PrintOutput,
+		Env:         i.Env,
+		Dir:         i.Dir,
+		FS:          i.FS,
+		Fetcher:     i.Fetcher,
+		namespace:   alias,
+		test:        i.test,
+		ctx:         i.ctx,
+	}
+	for _, statement := range statement.File.Statements {
+		namespace.Accept(statement)
+	}
+
+	i.Environment.Define(alias, env.VTImport, namespace)
+	return nil
+}
+
+// finds the imported interpreter for a name like ci.build, bound to this interpreter's
+// context and printer. name is what's left after the import's alias.
+func (i *Interpreter) lookupImport(targetStr string) (namespace *Interpreter, name string, isImported bool) {
+	alias, name, found := strings.Cut(targetStr, ".")
+	if !found {
+		return nil, "", false
+	}
+	imported, err := i.Environment.Get(alias, env.VTImport)
+	if err != nil {
+		return nil, "", false
+	}
+	bound := *imported.(*Interpreter)
+	bound.ctx = i.ctx
+	bound.Printer = i.Printer
+	bound.test = i.test
+	return &bound, name, true
+}
+
+func (i *Interpreter) VisitEnvStatement(statement tree.EnvStatement) interface{} {
+	for _, variable := range statement.Items {
+		i.Environment.Define(variable.Name.Text, env.VTEnv, variable.Initialiser)
+	}
+	return nil
+}
+
+func (i *Interpreter) VisitIfStatement(statement tree.IfStatement) interface{} {
+	body := statement.Else
+	if value.Truthy(i.evaluateExpr(statement.Condition)) {
+		body = statement.Then
+	}
+	i.executeBlock(body, env.NewEnvironment(i.Environment))
+	return nil
+}
+
+func (i *Interpreter) VisitForStatement(statement tree.ForStatement) interface{} {
+	iterable := i.evaluateExpr(statement.Iterable)
+	items, isList := iterable.(value.List)
+	if !isList {
+		panic(i.error(fmt.Sprintf("cannot loop over %v, expected a list", iterable)))
+	}
+
+	if statement.Parallel {
+		i.executeParallel(statement, items)
+		return nil
+	}
+
+	for _, item := range items {
+		environment := env.NewEnvironment(i.Environment)
+		environment.Bind(statement.Name.Text, item)
+		i.executeBlock(statement.Body, environment)
+	}
+	return nil
+}
+
+// runs each iteration of a loop in its own interpreter so they don't wait on each other
+func (i *Interpreter) executeParallel(statement tree.ForStatement, items value.List) {
+	// the first failure stops the other iterations
+	ctx, cancel := context.WithCancel(i.ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var failure error // the first iteration to fail, which cancelled the others
+	for _, item := range items {
+		fork := i.fork()
+		// each iteration is traced in its own lane
+		var span *trace.Span
+		fork.ctx, span = trace.Start(ctx, "iteration", fmt.Sprintf("%s %s", statement.Name.Text, item))
+		fork.Environment.Bind(statement.Name.Text, item)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				var err error
+				if r := recover(); r != nil {
+					if e, ok := r.(error); ok {
+						err = e
+					} else {
+						err = fmt.Errorf("unknown panic: %v", r)
+					}
+					once.Do(func() {
+						failure = err
+					})
+					cancel()
+				}
+				span.Fail(err)
+				span.Finish()
+			}()
+			// commands that weren't waited for, because the fork doesn't print, finish with it
+			defer fork.Printer.Discard()
+			for _, statement := range statement.Body {
+				fork.Accept(statement)
+			}
+		}()
+	}
+	wg.Wait()
+	i.checkCancelled()
+	if failure != nil {
+		panic(failure)
+	}
+}
+
+// creates an interpreter sharing this one's config with a child environment and its own printer
+func (i *Interpreter) fork() *Interpreter {
+	return &Interpreter{
+		Config:      i.Config,
+		Origin:      i.Origin,
+		Environment: env.NewEnvironment(i.Environment),
+		Printer:     &Printer{Out: i.Printer.Out, Err: i.Printer.Err, Handler: i.Printer.handler(), Redactor: i.Printer.Redactor},
+		PrintOutput: i.PrintOutput,
+		Env:         i.Env,
+		Dir:         i.Dir,
+		FS:          i.FS,
+		Fetcher:     i.Fetcher,
+		silent:      i.silent,
+		target:      i.target,
+		targetID:    i.targetID,
+		test:        i.test,
+		ctx:         i.ctx,
+	}
+}
+
+func (i *Interpreter) executeBlock(statements []tree.Statement, environment *env.Environment) {
+	startEnvironment := i.Environment
+	i.Environment = environment
+	defer func() {
+		i.Environment = startEnvironment
+	}()
+
+	for _, statement := range statements {
+		i.Accept(statement)
+	}
+}
+
 func (i *Interpreter) VisitExpressionStatement(statement tree.ExpressionStatement) interface{} {
 	return statement.Expression.Accept(i)
 }
@@ -257,45 +677,104 @@ func (i *Interpreter) VisitLiteralExpr(expr tree.Literal) interface{} {
 	return expr.Value
 }
 
-func (i *Interpreter) Extend(file string) error {
-	fileContents, err := os.ReadFile(file)
+func (i *Interpreter) VisitReferenceExpr(expr tree.Reference) interface{} {
+	variable, err := i.lookupVariable(expr.Name.Text)
 	if err != nil {
-		return err
+		panic(i.error(err.Error()))
 	}
+	return variable
+}
 
-	lexer := lex.New()
-	tokens, err := lexer.ReadInput(string(fileContents))
-	if err != nil {
-		return err
+func (i *Interpreter) VisitListExpr(expr tree.List) interface{} {
+	list := make(value.List, 0, len(expr.Items))
+	for _, item := range expr.Items {
+		list = append(list, i.evaluateExpr(item))
 	}
+	return list
+}
 
-	parser := parser.New()
-	statements, err := parser.Parse(tokens)
-	if err != nil {
-		return err
+func (i *Interpreter) VisitMapExpr(expr tree.Map) interface{} {
+	mapValue := make(value.Map, len(expr.Items))
+	for _, item := range expr.Items {
+		mapValue[item.Key.Text] = i.evaluateExpr(item.Value)
 	}
+	return mapValue
+}
 
-	_, err = i.Evaluate(statements)
+func (i *Interpreter) VisitCallExpr(expr tree.Call) interface{} {
+	builtin, ok := builtins[expr.Callee.Text]
+	if !ok {
+		panic(i.error(fmt.Sprintf("undefined function '%s'", expr.Callee.Text)))
+	}
+	arguments := make([]value.Value, 0, len(expr.Arguments))
+	for _, argument := range expr.Arguments {
+		arguments = append(arguments, i.evaluateExpr(argument))
+	}
+	if err := builtin.checkArity(len(arguments)); err != nil {
+		panic(i.error(fmt.Sprintf("%s %s", expr.Callee.Text, err.Error())))
+	}
+	result, err := builtin.Call(i, arguments)
 	if err != nil {
-		return err
+		panic(i.error(fmt.Sprintf("%s: %s", expr.Callee.Text, err.Error())))
 	}
+	return result
+}
 
-	return nil
+// evaluates a statement that should produce a value e.g. a config initialiser
+func (i *Interpreter) evaluate(statement tree.Statement) value.Value {
+	return i.toValue(i.Accept(statement))
 }
 
-func (i *Interpreter) lookupVariable(name string) (interface{}, error) {
+func (i *Interpreter) evaluateExpr(expr tree.Expression) value.Value {
+	return i.toValue(expr.Accept(i))
+}
+
+func (i *Interpreter) toValue(result interface{}) value.Value {
+	switch typed := result.(type) {
+	case value.Value:
+		return typed
+	case nil:
+		return nil
+	}
+	panic(i.error(fmt.Sprintf("%v is not a value", result)))
+}
+
+func (i *Interpreter) lookupVariable(name string) (value.Value, error) {
 	variable, err := i.Environment.Get(name, env.VTVar)
 	if err != nil {
 		return nil, err
 	}
+	resolved := i.resolveNamed("variable", name, variable)
+	if i.Environment.IsSecret(name) {
+		// before anything using the value is printed
+		i.Printer.Redactor.Add(resolved)
+	}
+	return resolved, nil
+}
+
+// resolves a variable, tracing how long it takes if it's computed by running commands
+func (i *Interpreter) resolveNamed(category string, name string, variable interface{}) value.Value {
+	if _, isComputed := variable.(tree.RunStatement); isComputed {
+		_, span := trace.Start(i.ctx, category, name)
+		defer func() {
+			finishSpan(span, recover())
+		}()
+	}
+	return i.resolve(variable)
+}
+
+// evaluates what a variable or environment variable was defined as
+func (i *Interpreter) resolve(variable interface{}) value.Value {
 	switch typedVal := variable.(type) {
 	// if run statement evaluate its actions now
 	case tree.RunStatement:
 		var strBuilder strings.Builder
 		for _, action := range typedVal.Body {
 			if run, ok := action.(tree.ActionStatement); ok {
-				cmd := createCommand(run.Body.Text, nil, i.Config.getShell())
+				cmd := i.createCommand(run.Body.Text, nil, nil)
+				cmd.Stderr = nil
 				stdOutStdErr, _ := cmd.CombinedOutput()
+				i.checkCancelled()
 				// opinionated: always trim trailing newline
 				// var runs are mostly variables inserted into something else
 				// where it's not helpful to have a trailing newline
@@ -303,11 +782,14 @@ func (i *Interpreter) lookupVariable(name string) (interface{}, error) {
 				strBuilder.WriteString(trimmedOutput)
 			}
 		}
-		return strBuilder.String(), nil
+		return value.String(strBuilder.String())
 	case tree.Statement:
-		return i.Accept(typedVal), nil
+		return i.evaluate(typedVal)
+	case value.Value:
+		// overrides are already values
+		return typedVal
 	default:
-		return "", nil
+		return value.String("")
 	}
 }
 
@@ -318,30 +800,130 @@ func (i *Interpreter) error(message string) *RuntimeError {
 	return err
 }
 
+// masks secrets in an error's message
+func (i *Interpreter) redactError(err error) error {
+	message := err.Error()
+	redacted := i.Printer.Redactor.Redact(message)
+	if redacted == message {
+		return err
+	}
+	redactedErr := &RuntimeError{
+		Message: redacted,
+		Err:     err,
+	}
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) {
+		redactedErr.ExitCode = runtimeErr.ExitCode
+		redactedErr.Err = runtimeErr.Err
+	}
+	return redactedErr
+}
+
 type RuntimeError struct {
-	Message string
+	Message  string
+	ExitCode int   // the exit code of the command that failed, if any
+	Err      error // the underlying error, if any
 }
 
 func (re *RuntimeError) Error() string {
 	return re.Message
 }
 
-func createCommand(cmdString string, variables map[string]interface{}, shell string) *exec.Cmd {
-	cmd := exec.Command(shell, "-c", cmdString)
-	cmd.Env = os.Environ()
-	for name, value := range variables {
-		cmd.Env = append(
-			cmd.Env,
-			fmt.Sprintf("%s=%s", name, trimQuotes(value)),
-		)
+func (re *RuntimeError) Unwrap() error {
+	return re.Err
+}
+
+func (i *Interpreter) cancelled() *RuntimeError {
+	err := i.error(i.ctx.Err().Error())
+	err.Err = i.ctx.Err()
+	return err
+}
+
+func (i *Interpreter) checkCancelled() {
+	if i.ctx.Err() != nil {
+		panic(i.cancelled())
+	}
+}
+
+// commands are killed, along with their children, when the interpreter's context is cancelled.
+// environment variables from env blocks are exported after variables so they take precedence.
+func (i *Interpreter) createCommand(cmdString string, variables map[string]value.Value, environment []string) *exec.Cmd {
+	cmd := exec.CommandContext(i.ctx, i.Config.getShell(), "-c", cmdString)
+	killProcessGroup(cmd)
+	cmd.Env = i.inheritedEnviron()
+	cmd.Dir = i.Dir
+	cmd.Stderr = i.Printer.err()
+	for name, variable := range variables {
+		if variable == nil {
+			continue
+		}
+		cmd.Env = append(cmd.Env, value.Export(name, variable)...)
 	}
+	cmd.Env = append(cmd.Env, environment...)
 	return cmd
 }
 
-func trimQuotes(input interface{}) interface{} {
-	switch out := input.(type) {
-	case string:
-		return strings.Trim(out, "\"")
+// the environment variables defined by env blocks in scope, as "name=value" pairs
+func (i *Interpreter) environmentVariables() []string {
+	defined := i.Environment.GetAll(env.VTEnv)
+	names := make([]string, 0, len(defined))
+	for name := range defined {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	environment := make([]string, 0, len(names))
+	for _, name := range names {
+		if evaluated := i.resolveNamed("env", name, defined[name]); evaluated != nil {
+			environment = append(environment, name+"="+evaluated.String())
+		}
+	}
+	return environment
+}
+
+// the environment commands start with. if clear_env is set only
+// the variables listed in inherit_env are kept.
+func (i *Interpreter) inheritedEnviron() []string {
+	environ := i.environ()
+	if !value.Truthy(i.Config["clear_env"]) {
+		return i.withMocks(environ)
+	}
+	inherit := make(map[string]bool)
+	if list, isList := i.Config["inherit_env"].(value.List); isList {
+		for _, name := range list {
+			inherit[name.String()] = true
+		}
+	}
+	inherited := make([]string, 0, len(inherit))
+	for _, pair := range environ {
+		if name, _, _ := strings.Cut(pair, "="); inherit[name] {
+			inherited = append(inherited, pair)
+		}
+	}
+	return i.withMocks(inherited)
+}
+
+func (i *Interpreter) environ() []string {
+	if i.Env != nil {
+		return append([]string{}, i.Env...)
+	}
+	return os.Environ()
+}
+
+func (i *Interpreter) getenv(name string) string {
+	environ := i.environ()
+	// later entries win, like exec.Cmd.Env
+	for index := len(environ) - 1; index >= 0; index-- {
+		if key, value, found := strings.Cut(environ[index], "="); found && key == name {
+			return value
+		}
+	}
+	return ""
+}
+
+func (i *Interpreter) readFile(name string) ([]byte, error) {
+	// remote files are always cached on disk
+	if _, isRemote := i.Fetcher.Source(name); i.FS != nil && !isRemote {
+		return fs.ReadFile(i.FS, filepath.ToSlash(filepath.Clean(name)))
 	}
-	return input
+	return os.ReadFile(name)
 }
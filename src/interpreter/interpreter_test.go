@@ -1,8 +1,16 @@
 package interpreter
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
 	"runny/src/token"
 	"runny/src/tree"
+	"runny/src/value"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -12,28 +20,111 @@ const (
 	origin = "/origin/path"
 )
 
-// func TestInterpreter_VisitRunStatement(t *testing.T) {
-// 	t.Run("simple command printed & executed accurately", func(t *testing.T) {
-// 		i := New(origin, true)
-// 		output, _ := captureOutput(func() error {
-// 			i.VisitRunStatement(tree.RunStatement{
-// 				Body: []tree.Statement{
-// 					tree.ActionStatement{
-// 						Body: token.Token{
-// 							Text: "echo \"hello world\"",
-// 						},
-// 					},
-// 				},
-// 			})
-// 			return nil
-// 		})
-// 		// hacky
-// 		expectedOutput := fmt.Sprintf(`%secho "hello world"%s
-// hello world
-// `, foreColour, aftColour)
-// 		assert.Equal(t, expectedOutput, output)
-// 	})
-// }
+func TestInterpreter_VisitRunStatement(t *testing.T) {
+	t.Run("simple command printed & executed accurately", func(t *testing.T) {
+		i := New(origin, true)
+		var output bytes.Buffer
+		i.Printer.Out = &output
+		i.VisitRunStatement(tree.RunStatement{
+			Body: []tree.Statement{
+				tree.ActionStatement{
+					Body: token.Token{
+						Text: "echo \"hello world\"",
+					},
+				},
+			},
+		})
+		assert.Equal(t, "echo \"hello world\"\nhello world\n", output.String())
+	})
+	t.Run("scripts are highlighted in colour", func(t *testing.T) {
+		i := New(origin, true)
+		var output bytes.Buffer
+		i.Printer.Handler = &TextHandler{Out: &output, Colour: true}
+		i.VisitRunStatement(tree.RunStatement{
+			Body: []tree.Statement{
+				tree.ActionStatement{
+					Body: token.Token{
+						Text: "echo \"hello world\"",
+					},
+				},
+			},
+		})
+		assert.Equal(t, foreColour+"echo \"hello world\""+aftColour+"\nhello world\n", output.String())
+	})
+	t.Run("actions run one after another", func(t *testing.T) {
+		i := New(origin, true)
+		i.Printer.Out = &bytes.Buffer{}
+		i.Dir = t.TempDir()
+		i.VisitRunStatement(tree.RunStatement{
+			Body: []tree.Statement{
+				tree.ActionStatement{Body: token.Token{Text: "sleep 0.1 && touch first"}},
+				tree.ActionStatement{Body: token.Token{Text: "test -f first && touch second"}},
+			},
+		})
+		assert.FileExists(t, filepath.Join(i.Dir, "second"))
+	})
+	t.Run("nothing runs after a failed action", func(t *testing.T) {
+		i := New(origin, true)
+		i.Printer.Out = &bytes.Buffer{}
+		i.Dir = t.TempDir()
+		assert.Panics(t, func() {
+			i.VisitRunStatement(tree.RunStatement{
+				Body: []tree.Statement{
+					tree.ActionStatement{Body: token.Token{Text: "sleep 0.1 && exit 3"}},
+					tree.ActionStatement{Body: token.Token{Text: "touch second"}},
+				},
+			})
+		})
+		assert.NoFileExists(t, filepath.Join(i.Dir, "second"))
+	})
+}
+
+func TestInterpreter_VisitForStatement(t *testing.T) {
+	loop := func(script string) tree.ForStatement {
+		return tree.ForStatement{
+			Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
+			Iterable: tree.List{Items: []tree.Expression{
+				tree.Literal{Value: value.String("a")},
+				tree.Literal{Value: value.String("b")},
+			}},
+			Body:     []tree.Statement{tree.ActionStatement{Body: token.Token{Text: script}}},
+			Parallel: true,
+		}
+	}
+	t.Run("parallel iterations finish their commands without printing", func(t *testing.T) {
+		i := New(origin, false)
+		i.Dir = t.TempDir()
+		_, err := i.Evaluate(context.Background(), []tree.Statement{loop(`sleep 0.1 && touch "$name"`)})
+		assert.NoError(t, err)
+		assert.FileExists(t, filepath.Join(i.Dir, "a"))
+		assert.FileExists(t, filepath.Join(i.Dir, "b"))
+	})
+	t.Run("parallel iterations fail without printing", func(t *testing.T) {
+		i := New(origin, false)
+		i.Dir = t.TempDir()
+		_, err := i.Evaluate(context.Background(), []tree.Statement{loop("exit 3")})
+		var runtimeErr *RuntimeError
+		assert.ErrorAs(t, err, &runtimeErr)
+		assert.Equal(t, 3, runtimeErr.ExitCode)
+	})
+}
+
+// a statement that panics with a string rather than an error
+type panicStatement struct {
+	tree.Node
+}
+
+func (ps panicStatement) Accept(visitor tree.StatementVisitor) interface{} {
+	panic("something went wrong")
+}
+
+func TestInterpreter_Recover(t *testing.T) {
+	statements := []tree.Statement{panicStatement{}}
+	_, err := New(origin, false).Evaluate(context.Background(), statements)
+	assert.EqualError(t, err, "something went wrong")
+	_, err = New(origin, false).ResolveVariables(context.Background(), "", statements)
+	assert.EqualError(t, err, "something went wrong")
+}
 
 func TestInterpreter_VisitConfigStatement(t *testing.T) {
 	t.Run("config variables are set", func(t *testing.T) {
@@ -44,58 +135,177 @@ func TestInterpreter_VisitConfigStatement(t *testing.T) {
 					Name: token.Token{Text: "shell", Type: token.STRING},
 					Initialiser: tree.ExpressionStatement{
 						Expression: tree.Literal{
-							Value: "/bin/zsh",
+							Value: value.String("/bin/zsh"),
 						},
 					},
 				},
 			},
 		})
 		assert.NotEmpty(t, i.Config["shell"], "config value was not set")
-		assert.Equal(t, i.Config["shell"], "/bin/zsh")
+		assert.Equal(t, value.String("/bin/zsh"), i.Config["shell"])
+	})
+}
+
+func TestInterpreter_VisitDescribeStatement(t *testing.T) {
+	t.Run("description statement printed", func(t *testing.T) {
+		i := New(origin, true)
+		var output bytes.Buffer
+		i.Printer.Out = &output
+		i.VisitDescribeStatement(tree.DescribeStatement{
+			Lines: []tree.Literal{
+				{
+					Value: "the command does X",
+				},
+			},
+		})
+		assert.Equal(t, "> the command does X\n", output.String())
+	})
+	t.Run("multiple description statements printed", func(t *testing.T) {
+		i := New(origin, true)
+		var output bytes.Buffer
+		i.Printer.Out = &output
+		i.VisitDescribeStatement(tree.DescribeStatement{
+			Lines: []tree.Literal{
+				{
+					Value: "the command does X",
+				},
+				{
+					Value: "the command does Y",
+				},
+			},
+		})
+		assert.Equal(t, "> the command does X\n> the command does Y\n", output.String())
 	})
 }
 
-// func TestInterpreter_VisitDescribeStatement(t *testing.T) {
-// 	t.Run("description statement printed", func(t *testing.T) {
-// 		i := New(origin, true)
-// 		output, _ := captureOutput(func() error {
-// 			i.VisitDescribeStatement(tree.DescribeStatement{
-// 				Lines: []tree.Literal{
-// 					{
-// 						Value: "the command does X",
-// 					},
-// 				},
-// 			})
-// 			return nil
-// 		})
-// 		assert.Equal(t, "> the command does X\n", output)
-// 	})
-// 	t.Run("multiple description statements printed", func(t *testing.T) {
-// 		i := New(origin, true)
-// 		output, _ := captureOutput(func() error {
-// 			i.VisitDescribeStatement(tree.DescribeStatement{
-// 				Lines: []tree.Literal{
-// 					{
-// 						Value: "the command does X",
-// 					},
-// 					{
-// 						Value: "the command does Y",
-// 					},
-// 				},
-// 			})
-// 			return nil
-// 		})
-// 		assert.Equal(t, "> the command does X\n> the command does Y\n", output)
-// 	})
-// }
-
-// func captureOutput(f func() error) (string, error) {
-// 	orig := os.Stdout
-// 	r, w, _ := os.Pipe()
-// 	os.Stdout = w
-// 	err := f()
-// 	os.Stdout = orig
-// 	w.Close()
-// 	out, _ := io.ReadAll(r)
-// 	return string(out), err
-// }
+func TestInterpreter_VisitCallExpr(t *testing.T) {
+	call := func(i *Interpreter, name string, arguments ...tree.Expression) interface{} {
+		return i.VisitCallExpr(tree.Call{
+			Callee:    token.Token{Type: token.IDENTIFIER, Text: name},
+			Arguments: arguments,
+		})
+	}
+	literal := func(v value.Value) tree.Expression {
+		return tree.Literal{Value: v}
+	}
+
+	t.Run("string functions", func(t *testing.T) {
+		i := New(origin, true)
+		assert.Equal(t, value.String("TIM"), call(i, "uppercase", literal(value.String("tim"))))
+		assert.Equal(t, value.String("fallback"), call(i, "default", literal(value.String("")), literal(value.String("fallback"))))
+		assert.Equal(t, value.String("a/b/c"), call(i, "join", literal(value.String("a")), literal(value.String("b/c"))))
+		assert.Equal(t, value.String(runtime.GOOS), call(i, "os"))
+	})
+	t.Run("env reads the process environment", func(t *testing.T) {
+		t.Setenv("RUNNY_TEST", "hello")
+		i := New(origin, true)
+		assert.Equal(t, value.String("hello"), call(i, "env", literal(value.String("RUNNY_TEST"))))
+	})
+	t.Run("file functions are relative to the origin", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "version.txt"), []byte("1.0.0\n"), 0644))
+		i := New(filepath.Join(dir, "runny.rny"), true)
+		i.Dir = dir
+		assert.Equal(t, value.String("1.0.0"), call(i, "read_file", literal(value.String("version.txt"))))
+		assert.Equal(t, value.List{value.String("version.txt")}, call(i, "glob", literal(value.String("*.txt"))))
+		assert.Equal(t, value.String(sha256Hex("1.0.0\n")), call(i, "sha256", literal(value.String("version.txt"))))
+	})
+	t.Run("glob matches are relative to where commands run", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "main.go"), []byte("package main\n"), 0644))
+		i := New(filepath.Join(dir, "sub", "runny.rny"), true)
+		i.Dir = dir
+		assert.Equal(t, value.List{value.String(filepath.Join("sub", "main.go"))}, call(i, "glob", literal(value.String("*.go"))))
+		i.Dir = filepath.Join(dir, "elsewhere")
+		assert.Equal(t, value.List{value.String(filepath.Join(dir, "sub", "main.go"))}, call(i, "glob", literal(value.String("*.go"))))
+	})
+	t.Run("git branch is read from HEAD", func(t *testing.T) {
+		dir := t.TempDir()
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, ".git"), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("ref: refs/heads/feature/x\n"), 0644))
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "service"), 0755))
+		i := New(filepath.Join(dir, "service", "runny.rny"), true)
+		assert.Equal(t, value.String("feature/x"), call(i, "git_branch"))
+	})
+	t.Run("wrong number of arguments", func(t *testing.T) {
+		i := New(origin, true)
+		assert.PanicsWithError(t, "runtime error: uppercase expects 1 argument(s), got 0\n", func() {
+			call(i, "uppercase")
+		})
+	})
+	t.Run("undefined function", func(t *testing.T) {
+		i := New(origin, true)
+		assert.PanicsWithError(t, "runtime error: undefined function 'nope'\n", func() {
+			call(i, "nope")
+		})
+	})
+}
+
+func sha256Hex(contents string) string {
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRedactor(t *testing.T) {
+	redactor := NewRedactor()
+	assert.False(t, redactor.Active())
+	redactor.Add(value.String("abc"))
+	redactor.Add(value.String("abcdef"))
+	redactor.Add(value.String("line one\nline two\n"))
+	redactor.Add(value.List{value.String("x1"), value.String("y2")})
+	redactor.Add(value.String(""))
+
+	assert.True(t, redactor.Active())
+	assert.Equal(t, "*** and *** ***", redactor.Redact("abcdef and abc abc"))
+	assert.Equal(t, "*** / ***", redactor.Redact("line one / line two"))
+	assert.Equal(t, "***,***", redactor.Redact("x1,y2"))
+	assert.Equal(t, "nothing secret", redactor.Redact("nothing secret"))
+
+	t.Run("secrets split across writes", func(t *testing.T) {
+		var lines []string
+		writer := &LineWriter{Line: func(line string) {
+			lines = append(lines, redactor.Redact(line))
+		}}
+		writer.Write([]byte("token ab"))
+		writer.Write([]byte("cdef\nlast abc"))
+		writer.Flush()
+		assert.Equal(t, []string{"token ***", "last ***"}, lines)
+	})
+}
+
+func TestSourceMap(t *testing.T) {
+	script := token.Token{
+		Type: token.SCRIPT,
+		Text: "echo one\necho two\nfoo",
+		File: "runny.rny",
+		Span: token.Span{Start: token.Pos{Line: 12}},
+	}
+	cases := []struct {
+		shell string
+		line  string
+		want  string
+	}{
+		{shell: "sh", line: "sh: 3: foo: not found", want: "runny.rny:14: foo: not found"},
+		{shell: "bash", line: "bash: line 3: foo: command not found", want: "runny.rny:14: foo: command not found"},
+		{shell: "/bin/zsh", line: "/bin/zsh:1: command not found: foo", want: "runny.rny:12: command not found: foo"},
+		// the script doesn't have a line 9, so the message isn't about it
+		{shell: "sh", line: "sh: 9: foo: not found", want: "sh: 9: foo: not found"},
+		{shell: "sh", line: "main.go:3: undefined: foo", want: "main.go:3: undefined: foo"},
+	}
+	for _, testcase := range cases {
+		source := newSourceMap(testcase.shell, script)
+		assert.Equal(t, testcase.want, source.translate(testcase.line))
+	}
+
+	// a script carries on after an error, so only one on its last line is where it failed
+	source := newSourceMap("sh", script)
+	assert.Equal(t, "runny.rny:12-14", source.location())
+	source.translate("sh: 2: echo: I/O error")
+	assert.Equal(t, "runny.rny:12-14", source.location())
+	source.translate("sh: 3: foo: not found")
+	assert.Equal(t, "runny.rny:14", source.location())
+
+	oneLine := newSourceMap("sh", token.Token{Text: "exit 3", File: "runny.rny", Span: token.Span{Start: token.Pos{Line: 5}}})
+	assert.Equal(t, "runny.rny:5", oneLine.location())
+}
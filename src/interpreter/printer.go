@@ -2,50 +2,173 @@ package interpreter
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
-	"strings"
+	"time"
 )
 
+// Verbosity is how much is printed besides the output of commands
+type Verbosity int
+
+const (
+	Normal  Verbosity = iota // scripts and descriptions are printed before they run
+	Quiet                    // only the output of commands
+	Verbose                  // also the environment commands run with and how long they took
+	Silent                   // only errors, command output is discarded
+)
+
+func (v Verbosity) printsScripts() bool {
+	return v == Normal || v == Verbose
+}
+
 // not the same as a "tree" statement
 // it just seemed the most appropriate word
 type Statement struct {
-	Cmd    *exec.Cmd
-	StdOut io.ReadCloser
-	StdErr io.ReadCloser
+	Cmd     *exec.Cmd
+	StdOut  io.ReadCloser
+	StdErr  io.ReadCloser
+	Started Event // the action_started event of the command
+	source  *sourceMap
 }
 
 type Printer struct {
 	Statements []Statement
+	Out        io.Writer // os.Stdout if nil
+	Err        io.Writer // os.Stderr if nil
+	Handler    Handler   // where events are sent, printed as text to Out and Err if nil
+	Redactor   *Redactor // masks secrets in every event
+}
+
+// Emit sends an event to the printer's handler
+func (p *Printer) Emit(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	p.handler().Handle(p.redact(event))
+}
+
+func (p *Printer) handler() Handler {
+	if p.Handler == nil {
+		p.Handler = &TextHandler{Out: p.Out, Err: p.Err}
+	}
+	return p.Handler
 }
 
+// prints and waits for everything pushed since the last print
 func (p *Printer) Print() {
-	for _, statement := range p.Statements {
+	statements := p.Statements
+	p.Statements = nil
+	for _, statement := range statements {
 		p.printStatement(statement)
 	}
 }
 
 func (p *Printer) printStatement(statement Statement) {
+	output := p.output(statement.Started, "stdout")
 	scanner := bufio.NewScanner(statement.StdOut)
 	for scanner.Scan() {
-		fmt.Println(scanner.Text())
+		output(scanner.Text())
 	}
 	statement.StdOut.Close()
 	if statement.Cmd != nil {
 		err := statement.Cmd.Wait()
+		if stderr, ok := statement.Cmd.Stderr.(*LineWriter); ok {
+			stderr.Flush()
+		}
+		finished := statement.Started
+		finished.Type = ActionFinished
+		finished.Time = time.Now()
+		finished.Duration = finished.Time.Sub(statement.Started.Time)
+		finished.Env = nil
 		if err != nil {
-			panic(p.error(err.Error()))
+			runtimeErr := p.failure(statement, err)
+			finished.ExitCode = runtimeErr.ExitCode
+			finished.Error = err.Error()
+			p.Emit(finished)
+			panic(runtimeErr)
 		}
+		p.Emit(finished)
 	}
 }
 
-func (p *Printer) Push(statement Statement) {
-	p.Statements = append(p.Statements, statement)
+// Discard waits for everything pushed since the last print without printing what it
+// writes, for interpreters that don't print output. A failed command still panics.
+func (p *Printer) Discard() {
+	statements := p.Statements
+	p.Statements = nil
+	for _, statement := range statements {
+		io.Copy(io.Discard, statement.StdOut)
+		statement.StdOut.Close()
+		if statement.Cmd == nil {
+			continue
+		}
+		if err := statement.Cmd.Wait(); err != nil {
+			panic(p.failure(statement, err))
+		}
+	}
 }
 
-func (p *Printer) PushStr(str string) {
-	p.Statements = append(p.Statements, StrStatement(str))
+// the error for a command that failed, with where it failed and its exit code
+func (p *Printer) failure(statement Statement, err error) *RuntimeError {
+	message := err.Error()
+	if statement.source != nil {
+		message = fmt.Sprintf("%s: %s", statement.source.location(), message)
+	}
+	runtimeErr := p.error(message)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		runtimeErr.ExitCode = exitErr.ExitCode()
+	}
+	return runtimeErr
+}
+
+// emits each line written by an action as an output event
+func (p *Printer) output(started Event, stream string) func(line string) {
+	return func(line string) {
+		p.Emit(Event{
+			Type:     Output,
+			ID:       started.ID,
+			TargetID: started.TargetID,
+			Target:   started.Target,
+			File:     started.File,
+			Line:     started.Line,
+			Stream:   stream,
+			Text:     line,
+		})
+	}
+}
+
+// where a command's stderr is written, as output events with the shell's line numbers
+// translated to the runny file's
+func (p *Printer) stderr(started Event, source *sourceMap) io.Writer {
+	output := p.output(started, "stderr")
+	return &LineWriter{Line: func(line string) {
+		output(source.translate(line))
+	}}
+}
+
+func (p *Printer) err() io.Writer {
+	return orStderr(p.Err)
+}
+
+func orStdout(out io.Writer) io.Writer {
+	if out == nil {
+		return os.Stdout
+	}
+	return out
+}
+
+func orStderr(err io.Writer) io.Writer {
+	if err == nil {
+		return os.Stderr
+	}
+	return err
+}
+
+func (p *Printer) Push(statement Statement) {
+	p.Statements = append(p.Statements, statement)
 }
 
 func (i *Printer) error(message string) *RuntimeError {
@@ -55,9 +178,31 @@ func (i *Printer) error(message string) *RuntimeError {
 	return err
 }
 
-func StrStatement(str string) Statement {
-	readCloser := io.NopCloser(strings.NewReader(str))
-	return Statement{
-		StdOut: readCloser,
+// LineWriter calls Line for every whole line written to it, without its newline,
+// so a secret split across writes is still masked
+type LineWriter struct {
+	Line    func(line string)
+	pending []byte // the start of a line that hasn't ended yet
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		end := bytes.IndexByte(w.pending, '\n')
+		if end < 0 {
+			return len(p), nil
+		}
+		w.Line(string(w.pending[:end]))
+		w.pending = w.pending[end+1:]
+	}
+}
+
+// Flush sends a line that didn't end in a newline
+func (w *LineWriter) Flush() {
+	if len(w.pending) == 0 {
+		return
 	}
+	line := string(w.pending)
+	w.pending = nil
+	w.Line(line)
 }
@@ -0,0 +1,27 @@
+//go:build !windows
+
+package interpreter
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// how long a cancelled command has to exit before it's killed
+const killGracePeriod = 5 * time.Second
+
+// starts the command in its own process group so that cancelling it
+// terminates everything it started, not just the shell
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := -cmd.Process.Pid
+		err := syscall.Kill(pgid, syscall.SIGTERM)
+		time.AfterFunc(killGracePeriod, func() {
+			syscall.Kill(pgid, syscall.SIGKILL)
+		})
+		return err
+	}
+	cmd.WaitDelay = killGracePeriod
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package interpreter
+
+import (
+	"os/exec"
+	"time"
+)
+
+const killGracePeriod = 5 * time.Second
+
+// windows has no process groups to signal, so only the shell is killed
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.WaitDelay = killGracePeriod
+}
@@ -0,0 +1,107 @@
+package interpreter
+
+import (
+	"runny/src/value"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask replaces the values of secret variables in everything runny prints
+const Mask = "***"
+
+// Redactor masks the values of secret variables. It's shared by every
+// interpreter running a file, including imported and forked ones.
+type Redactor struct {
+	mutex    sync.RWMutex
+	secrets  map[string]bool
+	replacer *strings.Replacer
+}
+
+func NewRedactor() *Redactor {
+	return &Redactor{
+		secrets: make(map[string]bool),
+	}
+}
+
+// Add masks a secret's value. Each line of a multi-line value is masked
+// too, because output is printed a line at a time.
+func (r *Redactor) Add(secret value.Value) {
+	if r == nil || secret == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	added := false
+	for _, str := range secretStrings(secret) {
+		for _, part := range append(strings.Split(str, "\n"), str) {
+			part = strings.TrimSpace(part)
+			if part == "" || r.secrets[part] {
+				continue
+			}
+			r.secrets[part] = true
+			added = true
+		}
+	}
+	if added {
+		r.replacer = r.newReplacer()
+	}
+}
+
+// lists and maps are exported item by item as well as whole
+func secretStrings(secret value.Value) []string {
+	strs := []string{secret.String()}
+	switch typed := secret.(type) {
+	case value.List:
+		for _, item := range typed {
+			strs = append(strs, secretStrings(item)...)
+		}
+	case value.Map:
+		for _, item := range typed {
+			strs = append(strs, secretStrings(item)...)
+		}
+	}
+	return strs
+}
+
+// longer secrets are replaced first so a secret containing another is masked whole
+func (r *Redactor) newReplacer() *strings.Replacer {
+	secrets := make([]string, 0, len(r.secrets))
+	for secret := range r.secrets {
+		secrets = append(secrets, secret)
+	}
+	sort.Slice(secrets, func(a, b int) bool {
+		if len(secrets[a]) != len(secrets[b]) {
+			return len(secrets[a]) > len(secrets[b])
+		}
+		return secrets[a] < secrets[b]
+	})
+	pairs := make([]string, 0, len(secrets)*2)
+	for _, secret := range secrets {
+		pairs = append(pairs, secret, Mask)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// Active reports whether there's anything to mask
+func (r *Redactor) Active() bool {
+	if r == nil {
+		return false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.replacer != nil
+}
+
+// Redact masks every secret in str
+func (r *Redactor) Redact(str string) string {
+	if r == nil {
+		return str
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if r.replacer == nil {
+		return str
+	}
+	return r.replacer.Replace(str)
+}
@@ -0,0 +1,67 @@
+package interpreter
+
+import (
+	"fmt"
+	"regexp"
+	"runny/src/token"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sourceMap translates the line numbers a shell reports errors at, which count from
+// the start of the script, to lines of the runny file the script is in
+type sourceMap struct {
+	file    string
+	start   int // the line of the file the script's first line is on
+	lines   int // how many lines the script has
+	pattern *regexp.Regexp
+	mutex   sync.Mutex
+	failed  int // the last line of the file an error was reported at, if any
+}
+
+// scripts are dedented rather than reflowed, so each line of a script is a line of the file
+func newSourceMap(shell string, script token.Token) *sourceMap {
+	start := script.Span.Start.Line
+	if start == 0 {
+		start = script.Line
+	}
+	return &sourceMap{
+		file:  script.File,
+		start: start,
+		lines: strings.Count(script.Text, "\n") + 1,
+		// e.g. "sh: 3: " from dash, "bash: line 3: " from bash and "zsh:3: " from zsh
+		pattern: regexp.MustCompile(`^` + regexp.QuoteMeta(shell) + `:(?: line)? ?(\d+): `),
+	}
+}
+
+// translate replaces the shell and line a line of stderr starts with by the file and line
+// e.g. "sh: 3: foo: not found" becomes "runny.rny:14: foo: not found"
+func (m *sourceMap) translate(text string) string {
+	match := m.pattern.FindStringSubmatchIndex(text)
+	if match == nil {
+		return text
+	}
+	line, err := strconv.Atoi(text[match[2]:match[3]])
+	if err != nil || line < 1 || line > m.lines {
+		return text
+	}
+	line += m.start - 1
+	m.mutex.Lock()
+	m.failed = line
+	m.mutex.Unlock()
+	return fmt.Sprintf("%s: %s", token.Location(m.file, line), text[match[1]:])
+}
+
+// where a script failed. A line an error was reported at is only where it failed if
+// it's the script's last, as a shell carries on after errors and exits with the status
+// of its last command. Otherwise it's the lines the script is on.
+func (m *sourceMap) location() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	end := m.start + m.lines - 1
+	if m.failed == end || m.lines == 1 {
+		return token.Location(m.file, end)
+	}
+	return fmt.Sprintf("%s-%d", token.Location(m.file, m.start), end)
+}
@@ -0,0 +1,232 @@
+package interpreter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runny/src/env"
+	"runny/src/token"
+	"runny/src/tree"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TestResult is how a test block went
+type TestResult struct {
+	Name     string
+	File     string
+	Line     int
+	Failures []string // expectations that weren't met
+	Err      error    // a failure the test didn't expect, like a command exiting non-zero without an expect exit
+	ExitCode int
+	Output   []string // every line the test's commands wrote
+	Duration time.Duration
+}
+
+func (r *TestResult) Passed() bool {
+	return len(r.Failures) == 0 && r.Err == nil
+}
+
+// the state of the test being run, shared by forked and imported interpreters
+type testState struct {
+	bin          string // where mocks are written, put first on the PATH
+	mutex        sync.Mutex
+	output       []string
+	stdout       []string
+	stderr       []string
+	failures     []string
+	err          error
+	exitCode     int
+	exitExpected bool
+}
+
+// FindTests returns the test blocks of a file. Tests in the files it extends or imports aren't included.
+func FindTests(statements []tree.Statement) []tree.TestStatement {
+	tests := make([]tree.TestStatement, 0)
+	for _, statement := range statements {
+		if test, isTest := statement.(tree.TestStatement); isTest {
+			tests = append(tests, test)
+		}
+	}
+	return tests
+}
+
+// RunTest runs a test block in a new temporary directory, after defining everything
+// in statements except their run statements. err is only returned if the test couldn't be started.
+func (i *Interpreter) RunTest(ctx context.Context, test tree.TestStatement, statements []tree.Statement) (result *TestResult, err error) {
+	result = &TestResult{
+		Name: test.Name.Text,
+		File: test.Name.File,
+		Line: test.Name.Line,
+	}
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	root, err := os.MkdirTemp("", "runny-test-")
+	if err != nil {
+		return result, err
+	}
+	defer os.RemoveAll(root)
+	state := &testState{bin: filepath.Join(root, "bin")}
+	i.Dir = filepath.Join(root, "work")
+	for _, dir := range []string{state.bin, i.Dir} {
+		if err := os.Mkdir(dir, 0o755); err != nil {
+			return result, err
+		}
+	}
+	i.test = state
+	i.Printer.Handler = &testCapture{handler: i.Printer.handler(), state: state}
+
+	definitions := make([]tree.Statement, 0, len(statements))
+	for _, statement := range statements {
+		switch statement.(type) {
+		case tree.RunStatement, tree.TestStatement:
+			continue
+		}
+		definitions = append(definitions, statement)
+	}
+	if _, err := i.Evaluate(ctx, definitions); err != nil {
+		return result, err
+	}
+
+	i.Environment = env.NewEnvironment(i.Environment)
+	for _, statement := range test.Body {
+		// once something fails only expectations are checked
+		if _, isExpect := statement.(tree.ExpectStatement); !isExpect && state.err != nil {
+			continue
+		}
+		if _, err := i.Evaluate(ctx, []tree.Statement{statement}); err != nil {
+			state.fail(err)
+		}
+	}
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	result.Failures = state.failures
+	result.ExitCode = state.exitCode
+	result.Output = state.output
+	if state.err != nil && !state.exitExpected {
+		result.Err = state.err
+	}
+	return result, nil
+}
+
+func (s *testState) fail(err error) {
+	s.err = err
+	s.exitCode = 1
+	var runtimeErr *RuntimeError
+	if errors.As(err, &runtimeErr) && runtimeErr.ExitCode != 0 {
+		s.exitCode = runtimeErr.ExitCode
+	}
+}
+
+// testCapture records the output of a test's commands as well as handling it
+type testCapture struct {
+	handler Handler
+	state   *testState
+}
+
+func (c *testCapture) Handle(event Event) {
+	if event.Type == Output {
+		c.state.mutex.Lock()
+		c.state.output = append(c.state.output, event.Text)
+		if event.Stream == "stderr" {
+			c.state.stderr = append(c.state.stderr, event.Text)
+		} else {
+			c.state.stdout = append(c.state.stdout, event.Text)
+		}
+		c.state.mutex.Unlock()
+	}
+	c.handler.Handle(event)
+}
+
+func (i *Interpreter) VisitTestStatement(statement tree.TestStatement) interface{} {
+	// tests are only run by RunTest
+	return nil
+}
+
+// mocks are scripts with the command's name, found before the real command on the PATH
+func (i *Interpreter) VisitMockStatement(statement tree.MockStatement) interface{} {
+	if i.test == nil {
+		panic(i.error("mock can only be used in a test"))
+	}
+	shell, err := exec.LookPath(i.Config.getShell())
+	if err != nil {
+		panic(i.error(fmt.Sprintf("could not mock %s: %s", statement.Name.Text, err.Error())))
+	}
+	script := fmt.Sprintf("#!%s\n%s\n", shell, statement.Body.Text)
+	if err := os.WriteFile(filepath.Join(i.test.bin, statement.Name.Text), []byte(script), 0o755); err != nil {
+		panic(i.error(fmt.Sprintf("could not mock %s: %s", statement.Name.Text, err.Error())))
+	}
+	return nil
+}
+
+func (i *Interpreter) VisitExpectStatement(statement tree.ExpectStatement) interface{} {
+	if i.test == nil {
+		panic(i.error("expect can only be used in a test"))
+	}
+	expected := i.evaluateExpr(statement.Expected)
+	state := i.test
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	var failure string
+	if statement.Subject.Text == "exit" {
+		state.exitExpected = true
+		if expected.String() != fmt.Sprint(state.exitCode) {
+			failure = fmt.Sprintf("expected exit %s, got %d", expected, state.exitCode)
+		}
+	} else {
+		lines := state.output
+		switch statement.Subject.Text {
+		case "stdout":
+			lines = state.stdout
+		case "stderr":
+			lines = state.stderr
+		}
+		actual := strings.Join(lines, "\n")
+		switch statement.Operator.Text {
+		case "contains":
+			if !strings.Contains(actual, expected.String()) {
+				failure = fmt.Sprintf("expected %s to contain %q", statement.Subject.Text, expected)
+			}
+		case "equals":
+			if actual != expected.String() {
+				failure = fmt.Sprintf("expected %s to equal %q, got %q", statement.Subject.Text, expected, actual)
+			}
+		case "matches":
+			pattern, err := regexp.Compile(expected.String())
+			if err != nil {
+				failure = fmt.Sprintf("invalid pattern %q: %s", expected, err.Error())
+			} else if !pattern.MatchString(actual) {
+				failure = fmt.Sprintf("expected %s to match %q", statement.Subject.Text, expected)
+			}
+		}
+	}
+	if failure != "" {
+		location := token.Location(statement.Keyword.File, statement.Keyword.Line)
+		state.failures = append(state.failures, fmt.Sprintf("%s: %s", location, i.Printer.Redactor.Redact(failure)))
+	}
+	return nil
+}
+
+// puts a test's mocks first on the PATH
+func (i *Interpreter) withMocks(environ []string) []string {
+	if i.test == nil {
+		return environ
+	}
+	for index := len(environ) - 1; index >= 0; index-- {
+		if path, found := strings.CutPrefix(environ[index], "PATH="); found {
+			environ[index] = "PATH=" + i.test.bin + string(os.PathListSeparator) + path
+			return environ
+		}
+	}
+	return append(environ, "PATH="+i.test.bin)
+}
@@ -3,9 +3,11 @@ package lex
 import (
 	"fmt"
 	"runny/src/token"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 func New() *Lexer {
@@ -19,27 +21,64 @@ func New() *Lexer {
 }
 
 type Lexer struct {
-	Input   string
-	Tokens  []token.Token
-	Start   int
-	Current int
-	Line    int
-	Depth   int // number of braces deep
-	Context Context
-}
-
+	File       string // tagged onto every token
+	Input      string
+	Tokens     []token.Token // all of them with ReadInput, only those not yet returned with Next
+	Start      int
+	Current    int
+	Line       int
+	Depth      int // number of braces deep
+	Context    Context
+	last       token.Token // the last token lexed, which decides what some characters mean
+	lineStarts []int       // the offset of each line in Input, for working out columns
+	scanned    int         // how far lineStarts has been filled in
+}
+
+// ReadInput lexes all of input at once by reading every token from Next
 func (l *Lexer) ReadInput(input string) ([]token.Token, error) {
 	l.Input = input
-	for !l.isAtEnd() {
-		l.Start = l.Current
-		err := l.readChar()
+	var tokens []token.Token
+	for {
+		next, err := l.Next()
 		if err != nil {
+			// keep what was lexed before the error, including what Next hadn't returned yet
+			l.Tokens = append(tokens, l.Tokens...)
 			return []token.Token{}, err
 		}
+		tokens = append(tokens, next)
+		if next.Type == token.EOF {
+			break
+		}
+	}
+	l.Tokens = tokens
+	return tokens, nil
+}
+
+// Next lexes only as much of Input as it needs to return the next token, so the
+// parser can start before a file has been read. Tokens aren't kept once they're
+// returned. It returns EOF once the input is used up.
+func (l *Lexer) Next() (token.Token, error) {
+	for len(l.Tokens) == 0 {
+		if l.isAtEnd() {
+			if l.last.Type == token.EOF {
+				return l.last, nil
+			}
+			l.addEOF()
+			break
+		}
+		l.Start = l.Current
+		if err := l.readChar(); err != nil {
+			return token.Token{}, err
+		}
 	}
+	next := l.Tokens[0]
+	l.Tokens = l.Tokens[:copy(l.Tokens, l.Tokens[1:])]
+	return next, nil
+}
+
+func (l *Lexer) addEOF() {
 	l.Start++
-	l.addToken(token.EOF, "")
-	return l.Tokens, nil
+	l.addToken(token.EOF, "", withSpan(len(l.Input), len(l.Input)))
 }
 
 func (l *Lexer) readChar() error {
@@ -49,19 +88,32 @@ func (l *Lexer) readChar() error {
 	case "{":
 		l.addToken(token.LEFT_BRACE, char)
 		l.Depth++
-		if l.Context.current() == token.RUN {
-			l.matchScript()
+		if current := l.Context.current(); current == token.RUN || current == token.MOCK {
+			return l.matchScript()
 		}
 	case "}":
 		l.addToken(token.RIGHT_BRACE, char)
 		l.Depth--
 		l.Context.resetContext()
+	case "[":
+		l.addToken(token.LEFT_BRACKET, char)
+	case "]":
+		l.addToken(token.RIGHT_BRACKET, char)
+	case "(":
+		l.addToken(token.LEFT_PAREN, char)
+	case ")":
+		l.addToken(token.RIGHT_PAREN, char)
 	case ",":
 		l.addToken(token.COMMA, char)
 	case "$":
 		l.matchIdentifier()
 	case "#":
 		l.matchComment()
+	case "<":
+		if l.peek() == "<" && l.opensRawScript() {
+			return l.matchRawScript()
+		}
+		return l.error(char, "unsupported type")
 	case "\n":
 		l.Line++
 	case " ", "\r", "\t":
@@ -71,8 +123,10 @@ func (l *Lexer) readChar() error {
 			l.matchNumber()
 		} else if isLetter(char) {
 			l.matchIdentifier()
+		} else if char == "`" && l.peek() == "`" && l.peekNext() == "`" && l.opensRawScript() {
+			return l.matchFencedScript()
 		} else if char == "`" || char == "\"" {
-			l.matchString(char)
+			return l.matchString(char)
 		} else {
 			return l.error(char, "unsupported type")
 		}
@@ -102,18 +156,53 @@ func withPosition(position, line, depth int) func(*token.Token) {
 	}
 }
 
+// the span of a token that isn't just what the lexer has read since Start, like a script
+// without the space around it
+func withSpan(start, end int) func(*token.Token) {
+	return func(token *token.Token) {
+		token.Span.Start.Offset = start
+		token.Span.End.Offset = end
+	}
+}
+
 func (l *Lexer) addToken(tokenType token.TokenType, text string, options ...TokenOptionFunc) {
 	token := token.Token{
 		Type:     tokenType,
 		Text:     text,
+		File:     l.File,
 		Position: l.Start,
 		Line:     l.Line,
 		Depth:    l.Depth,
 	}
+	token.Span.Start.Offset = l.Start
+	token.Span.End.Offset = l.Current
 	for _, opt := range options {
 		opt(&token)
 	}
+	token.Span.File = l.File
+	token.Span.Start = l.pos(token.Span.Start.Offset)
+	token.Span.End = l.pos(token.Span.End.Offset)
 	l.Tokens = append(l.Tokens, token)
+	l.last = token
+}
+
+// the line and column of an offset in Input. Lines are only found as far as the lexer has got.
+func (l *Lexer) pos(offset int) token.Pos {
+	if l.lineStarts == nil {
+		l.lineStarts = []int{0}
+	}
+	for ; l.scanned < offset && l.scanned < len(l.Input); l.scanned++ {
+		if l.Input[l.scanned] == '\n' {
+			l.lineStarts = append(l.lineStarts, l.scanned+1)
+		}
+	}
+	// the last line starting at or before offset
+	line := sort.SearchInts(l.lineStarts, offset+1) - 1
+	return token.Pos{
+		Offset: offset,
+		Line:   line + 1,
+		Column: offset - l.lineStarts[line] + 1,
+	}
 }
 
 func (l *Lexer) TokenTypes() []token.TokenType {
@@ -129,13 +218,7 @@ func (l *Lexer) isAtEnd() bool {
 }
 
 func (l *Lexer) lastToken() token.Token {
-	if len(l.Tokens) == 0 {
-		return token.Token{}
-	}
-	if len(l.Tokens) == 1 {
-		return l.Tokens[0]
-	}
-	return l.Tokens[len(l.Tokens)-1]
+	return l.last
 }
 
 func (l *Lexer) peek() string {
@@ -145,75 +228,161 @@ func (l *Lexer) peek() string {
 	return string(l.Input[l.Current])
 }
 
+func (l *Lexer) peekNext() string {
+	if l.Current+1 >= len(l.Input) {
+		return ""
+	}
+	return string(l.Input[l.Current+1])
+}
+
+// the next character that isn't a space or tab, without consuming anything
+func (l *Lexer) peekWord() string {
+	for index := l.Current; index < len(l.Input); index++ {
+		if char := string(l.Input[index]); char != " " && char != "\t" {
+			return char
+		}
+	}
+	return ""
+}
+
 func (l *Lexer) matchComment() {
 	for !l.isAtEnd() && l.peek() != "\n" {
 		l.nextChar()
 	}
 }
 
-func (l *Lexer) matchScript() {
-	start := l.Start + 1
-	firstLine := l.Line
-	bracesCount := 1
-	for !l.isAtEnd() {
-		if l.peek() == "\n" {
+// backtick strings are raw, double quoted strings can have escapes like \" and \n
+func (l *Lexer) matchString(delimiter string) error {
+	line := l.Line
+	var text strings.Builder
+	for l.peek() != delimiter && !l.isAtEnd() {
+		char := l.nextChar()
+		if char == "\n" {
 			l.Line++
-		} else if l.peek() == "{" {
-			bracesCount++
-		} else if l.peek() == "}" {
-			bracesCount--
-			if bracesCount == 0 {
-				break
+		}
+		if char == "\\" && delimiter == "\"" {
+			escaped, err := l.readEscape()
+			if err != nil {
+				return err
 			}
+			char = escaped
 		}
-		l.nextChar()
+		text.WriteString(char)
 	}
-	text := l.Input[start:l.Current]
-	if len(text) > 0 {
-		l.addToken(
-			token.SCRIPT,
-			strings.TrimSpace(text),
-			withPosition(start, firstLine, l.Depth),
-		)
+	if l.isAtEnd() {
+		return l.errorAt(line, delimiter, "string has no closing quote")
 	}
+	l.nextChar()
+	l.addToken(token.STRING, fmt.Sprintf("\"%s\"", text.String()))
+	return nil
 }
 
-func (l *Lexer) matchString(delimiter string) {
-	for l.peek() != delimiter && !l.isAtEnd() {
-		if l.peek() == "\n" {
-			l.Line++
+var escapes = map[string]string{
+	"n":  "\n",
+	"t":  "\t",
+	"r":  "\r",
+	"\"": "\"",
+	"\\": "\\",
+}
+
+// reads the escape sequence after a backslash. unknown escapes like \d are kept as they are.
+func (l *Lexer) readEscape() (string, error) {
+	if l.isAtEnd() {
+		return "\\", nil
+	}
+	char := l.nextChar()
+	if escaped, ok := escapes[char]; ok {
+		return escaped, nil
+	}
+	switch char {
+	case "u", "U":
+		// \u00e9 or \U0001f600
+		size := 4
+		if char == "U" {
+			size = 8
 		}
-		l.nextChar()
+		end := min(l.Current+size, len(l.Input))
+		digits := l.Input[l.Current:end]
+		code, err := strconv.ParseUint(digits, 16, 32)
+		if err != nil || len(digits) != size || !utf8.ValidRune(rune(code)) {
+			return "", l.error("\\"+char+digits, "invalid unicode escape")
+		}
+		l.Current = end
+		return string(rune(code)), nil
+	case "\n":
+		l.Line++
 	}
-	l.nextChar()
-	text := l.Input[l.Start+1 : l.Current-1]
-	l.addToken(token.STRING, fmt.Sprintf("\"%s\"", text))
+	return "\\" + char, nil
 }
 
 func (l *Lexer) matchNumber() {
 	for isDigit(l.peek()) {
 		l.nextChar()
 	}
+	if l.peek() == "." && isDigit(l.peekNext()) {
+		l.nextChar()
+		for isDigit(l.peek()) {
+			l.nextChar()
+		}
+	}
 	l.addToken(token.NUMBER, l.Input[l.Start:l.Current])
 }
 
 func (l *Lexer) matchIdentifier() {
 	identifier := l.readIdentifier()
-	if keyword, isKeyword := l.isKeyword(identifier); isKeyword {
+	if keyword, isKeyword := l.isKeyword(identifier); isKeyword && !l.isCall(keyword) && !l.isName(keyword) {
 		l.addToken(keyword, identifier)
-		l.Context.setContext(keyword)
+		if opensBlock(keyword) {
+			l.Context.setContext(keyword)
+		}
 	} else if keyword, mod, _, hasTag := l.hasModifier(identifier); hasTag {
 		l.addToken(*keyword, identifier, withModifier(*mod))
 		l.Context.setContext(*keyword)
 	} else {
 		// we're in target context if running target
 		if l.lastToken().Type == token.RUN {
-			l.Context.replaceContext(token.TARGET)
+			if l.peekWord() == "{" {
+				l.Context.replaceContext(token.TARGET)
+			} else {
+				// a target run without a block has nothing to close its context
+				l.Context.resetContext()
+			}
 		}
 		l.addToken(token.IDENTIFIER, identifier)
 	}
 }
 
+// env is also a built-in function e.g. env("HOME")
+func (l *Lexer) isCall(keyword token.TokenType) bool {
+	return keyword == token.ENV && l.peek() == "("
+}
+
+// test is only a keyword before a test's name, mock and expect only inside a
+// test, and env only before its block, so they can still be used as names
+// e.g. target test or target env
+func (l *Lexer) isName(keyword token.TokenType) bool {
+	switch keyword {
+	case token.ENV:
+		last := l.lastToken().Type
+		return l.peekWord() != "{" || last == token.TARGET || last == token.RUN
+	case token.TEST:
+		next := l.peekWord()
+		return next != "\"" && next != "`"
+	case token.MOCK, token.EXPECT:
+		return !l.Context.contains(token.TEST)
+	}
+	return false
+}
+
+// literals, operators, imports and expectations don't open a block
+func opensBlock(keyword token.TokenType) bool {
+	switch keyword {
+	case token.TRUE, token.FALSE, token.IN, token.IMPORT, token.AS, token.EXPECT:
+		return false
+	}
+	return true
+}
+
 func (l *Lexer) isKeyword(identifier string) (token.TokenType, bool) {
 	keyword, isKeyword := token.Keywords[identifier]
 	return keyword, isKeyword
@@ -254,6 +423,10 @@ func (le *LexError) Error() string {
 }
 
 func (l *Lexer) error(ch string, message string) *LexError {
+	return l.errorAt(l.Line, ch, message)
+}
+
+func (l *Lexer) errorAt(line int, ch string, message string) *LexError {
 	var where string
 	if ch == "\n" {
 		where = "at '\\n'"
@@ -261,7 +434,7 @@ func (l *Lexer) error(ch string, message string) *LexError {
 		where = "at '" + ch + "'"
 	}
 	err := &LexError{
-		Message: fmt.Sprintf("[line %d] lex error %s: %s\n", l.Line, where, message),
+		Message: fmt.Sprintf("[%s] lex error %s: %s\n", token.Location(l.File, line), where, message),
 	}
 	return err
 }
@@ -280,6 +453,15 @@ func (c *Context) current() token.TokenType {
 	return c.Stack[len(c.Stack)-1] // last item
 }
 
+func (c *Context) contains(t token.TokenType) bool {
+	for _, context := range c.Stack {
+		if context == t {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Context) setContext(t token.TokenType) {
 	c.Stack = append(c.Stack, t)
 }
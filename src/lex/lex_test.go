@@ -229,6 +229,319 @@ func TestLexer(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:        "basic: typed values",
+			inputString: `var { ratio 0.5, debug true, files ["a", "b"] }`,
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.VAR, Text: "var"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "ratio"},
+					{Type: token.NUMBER, Text: "0.5"},
+					{Type: token.COMMA, Text: ","},
+					{Type: token.IDENTIFIER, Text: "debug"},
+					{Type: token.TRUE, Text: "true"},
+					{Type: token.COMMA, Text: ","},
+					{Type: token.IDENTIFIER, Text: "files"},
+					{Type: token.LEFT_BRACKET, Text: "["},
+					{Type: token.STRING, Text: `"a"`},
+					{Type: token.COMMA, Text: ","},
+					{Type: token.STRING, Text: `"b"`},
+					{Type: token.RIGHT_BRACKET, Text: "]"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "basic: if else",
+			inputString: `if $debug { run { echo "debug" } } else { run { echo "quiet" } }`,
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.IF, Text: "if"},
+					{Type: token.IDENTIFIER, Text: "$debug"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: `echo "debug"`},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.ELSE, Text: "else"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: `echo "quiet"`},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "basic: for loop",
+			inputString: `for:parallel file in glob("*.go") { run { gofmt -l $file } }`,
+			want: func() []token.Token {
+				parallel := token.PARALLEL
+				return []token.Token{
+					{Type: token.FOR, Text: "for:parallel", Modifier: &parallel},
+					{Type: token.IDENTIFIER, Text: "file"},
+					{Type: token.IN, Text: "in"},
+					{Type: token.IDENTIFIER, Text: "glob"},
+					{Type: token.LEFT_PAREN, Text: "("},
+					{Type: token.STRING, Text: `"*.go"`},
+					{Type: token.RIGHT_PAREN, Text: ")"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: `gofmt -l $file`},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "import with alias",
+			inputString: "import \"ci.rny\" as ci\nrun ci.build",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.IMPORT, Text: "import"},
+					{Type: token.STRING, Text: "\"ci.rny\""},
+					{Type: token.AS, Text: "as"},
+					{Type: token.IDENTIFIER, Text: "ci"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.IDENTIFIER, Text: "ci.build"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "env block and env call",
+			inputString: "env { GOOS \"linux\" } var { home env(\"HOME\") }",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.ENV, Text: "env"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "GOOS"},
+					{Type: token.STRING, Text: "\"linux\""},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.VAR, Text: "var"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "home"},
+					{Type: token.IDENTIFIER, Text: "env"},
+					{Type: token.LEFT_PAREN, Text: "("},
+					{Type: token.STRING, Text: "\"HOME\""},
+					{Type: token.RIGHT_PAREN, Text: ")"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "env as a name",
+			inputString: "target env { run { echo } } run env",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.TARGET, Text: "target"},
+					{Type: token.IDENTIFIER, Text: "env"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: "echo"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.IDENTIFIER, Text: "env"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "test block with mock and expect",
+			inputString: "target test { run build } test \"deploys\" { mock docker { echo \"docker $@\" } run test expect exit 0 }",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.TARGET, Text: "target"},
+					{Type: token.IDENTIFIER, Text: "test"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.IDENTIFIER, Text: "build"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.TEST, Text: "test"},
+					{Type: token.STRING, Text: "\"deploys\""},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.MOCK, Text: "mock"},
+					{Type: token.IDENTIFIER, Text: "docker"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: "echo \"docker $@\""},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.IDENTIFIER, Text: "test"},
+					{Type: token.EXPECT, Text: "expect"},
+					{Type: token.IDENTIFIER, Text: "exit"},
+					{Type: token.NUMBER, Text: "0"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "braces in script quotes and comments",
+			inputString: "run { echo \"}\" '}' $'\\'}' # }\n  awk '{print $5}' ${#x} }",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: "echo \"}\" '}' $'\\'}' # }\nawk '{print $5}' ${#x}"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "braces in a command substitution in a string",
+			inputString: "run { echo \"$(echo \"}\")\" }",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: "echo \"$(echo \"}\")\""},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "heredoc in a script",
+			inputString: "run {\n    cat <<-'EOF' > out\n    }\n    EOF\n    echo $((1 << 2))\n}",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: "cat <<-'EOF' > out\n}\nEOF\necho $((1 << 2))"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "shifts in arithmetic aren't heredocs",
+			inputString: "run {\n    (( x = a << b ))\n    let \"y = a << b\"\n    if ((x<<2)); then echo big; fi\n}",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: "(( x = a << b ))\nlet \"y = a << b\"\nif ((x<<2)); then echo big; fi"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "raw script with a heredoc delimiter",
+			inputString: "target build {\n    run <<EOF\n        echo '{\"a\": 1}' | jq .\n          if [ -n \"$x\" ]; then echo }\n\n    EOF\n}",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.TARGET, Text: "target"},
+					{Type: token.IDENTIFIER, Text: "build"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.SCRIPT, Text: "echo '{\"a\": 1}' | jq .\n  if [ -n \"$x\" ]; then echo }\n"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "raw script in fences",
+			inputString: "run:silent ```sh\n\tawk '{ print $1 }' <<< \"a b\"\n```",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.RUN, Text: "run:silent"},
+					{Type: token.SCRIPT, Text: "awk '{ print $1 }' <<< \"a b\""},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "raw mock script",
+			inputString: "test \"t\" { mock git <<'END'\n  echo git\n  END\n}",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.TEST, Text: "test"},
+					{Type: token.STRING, Text: "\"t\""},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.MOCK, Text: "mock"},
+					{Type: token.IDENTIFIER, Text: "git"},
+					{Type: token.SCRIPT, Text: "echo git"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "raw script without its closing delimiter",
+			inputString: "run <<EOF\necho hi\n",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.RUN, Text: "run"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name:        "script with an unclosed quote",
+			inputString: "run { echo don't }",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name:        "string escapes",
+			inputString: "var { a \"say \\\"hi\\\"\\n\\t\\u00e9 \\d\" b `raw \\n` }",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.VAR, Text: "var"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "a"},
+					{Type: token.STRING, Text: "\"say \"hi\"\n\té \\d\""},
+					{Type: token.IDENTIFIER, Text: "b"},
+					{Type: token.STRING, Text: "\"raw \\n\""},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
+		{
+			name:        "invalid unicode escape",
+			inputString: "var { a \"\\u12\" }",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.VAR, Text: "var"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "a"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name:        "expect outside a test is a name",
+			inputString: "var { expect \"x\" }",
+			want: func() []token.Token {
+				return []token.Token{
+					{Type: token.VAR, Text: "var"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "expect"},
+					{Type: token.STRING, Text: "\"x\""},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+		},
 	}
 
 	for _, testcase := range cases {
@@ -258,3 +571,71 @@ func tokenSlicesMatch(a []token.Token, b []token.Token) bool {
 	}
 	return true
 }
+
+func TestLexer_Next(t *testing.T) {
+	l := lex.New()
+	l.Input = "run build\nrun { echo ~ }\n~"
+	want := []token.TokenType{token.RUN, token.IDENTIFIER, token.RUN, token.LEFT_BRACE, token.SCRIPT, token.RIGHT_BRACE}
+	for _, tokenType := range want {
+		next, err := l.Next()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if next.Type != tokenType {
+			t.Fatalf("want %s, got %s", token.TokenTypeNames[tokenType], token.TokenTypeNames[next.Type])
+		}
+	}
+	// returned tokens aren't kept
+	if len(l.Tokens) != 0 {
+		t.Fatalf("want no tokens kept, got %v", lex.TokenNames(l.Tokens))
+	}
+	// the error is only found once the lexer gets to it
+	if _, err := l.Next(); err == nil {
+		t.Fatal("want an error for '~'")
+	}
+
+	l = lex.New()
+	for range 2 {
+		if next, err := l.Next(); err != nil || next.Type != token.EOF {
+			t.Fatalf("want EOF, got %v %v", next, err)
+		}
+	}
+}
+
+func TestLexer_Spans(t *testing.T) {
+	l := lex.New()
+	l.File = "runny.rny"
+	tokens, err := l.ReadInput("var { name \"Tim\" }\ntarget greet {\n    run {\n        echo hi\n    }\n}")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	cases := []struct {
+		index int
+		want  token.Span
+	}{
+		{
+			index: 3, // the string, quotes and all
+			want: token.Span{
+				File:  "runny.rny",
+				Start: token.Pos{Offset: 11, Line: 1, Column: 12},
+				End:   token.Pos{Offset: 16, Line: 1, Column: 17},
+			},
+		},
+		{
+			index: 10, // the script without the space around it
+			want: token.Span{
+				File:  "runny.rny",
+				Start: token.Pos{Offset: 52, Line: 4, Column: 9},
+				End:   token.Pos{Offset: 59, Line: 4, Column: 16},
+			},
+		},
+	}
+	for _, testcase := range cases {
+		if got := tokens[testcase.index].Span; got != testcase.want {
+			t.Errorf("%s: want %#v, got %#v", lex.TokenNames(tokens[testcase.index:testcase.index+1]), testcase.want, got)
+		}
+	}
+	if got := tokens[10].Span.String(); got != "runny.rny:4:9" {
+		t.Errorf("want runny.rny:4:9, got %s", got)
+	}
+}
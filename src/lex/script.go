@@ -0,0 +1,376 @@
+package lex
+
+import (
+	"fmt"
+	"runny/src/token"
+	"strings"
+	"unicode"
+)
+
+// what's been read of a script so far
+type scriptState struct {
+	start    int       // where the script starts in the input
+	braces   int       // braces opened and not yet closed, including the block's own
+	heredocs []heredoc // started on the current line, their bodies start on the next
+}
+
+type heredoc struct {
+	delimiter string
+	line      int
+}
+
+// matchScript reads a script up to the brace that closes its block. Braces are only
+// counted outside of shell quotes, comments and heredocs, so echo "}" doesn't end the block.
+// The script is dedented the same way whether it's printed or run.
+func (l *Lexer) matchScript() error {
+	start := l.Start + 1
+	firstLine := l.Line
+	state := &scriptState{start: start, braces: 1}
+	for !l.isAtEnd() {
+		if l.peek() == "}" && state.braces == 1 {
+			break
+		}
+		if err := l.scanScript(state); err != nil {
+			return err
+		}
+	}
+	if l.isAtEnd() {
+		return l.errorAt(firstLine, "{", "script has no closing brace")
+	}
+	text := l.Input[start:l.Current]
+	if len(text) > 0 {
+		trimmed := strings.TrimSpace(text)
+		begin := start + len(text) - len(strings.TrimLeftFunc(text, unicode.IsSpace))
+		l.addToken(
+			token.SCRIPT,
+			dedentScript(trimmed),
+			withPosition(start, firstLine, l.Depth),
+			withSpan(begin, begin+len(trimmed)),
+		)
+	}
+	return nil
+}
+
+// reads the next character of a script, along with anything it starts that braces don't count in
+func (l *Lexer) scanScript(state *scriptState) error {
+	char := l.nextScriptChar()
+	switch char {
+	case "\n":
+		return l.skipHeredocs(state)
+	case "\\":
+		l.nextScriptChar()
+	case "'":
+		return l.skipQuoted("'", false)
+	case "\"":
+		return l.skipDoubleQuoted()
+	case "`":
+		return l.skipQuoted("`", true)
+	case "$":
+		if l.peek() == "'" {
+			// $'...' strings have escapes, unlike '...'
+			l.nextScriptChar()
+			return l.skipQuoted("'", true)
+		}
+		if l.peek() == "(" && l.peekNext() == "(" {
+			return l.skipArithmetic("$((", 0)
+		}
+	case "(":
+		if l.peek() == "(" && l.startsWord(state, l.Current-1) {
+			return l.skipArithmetic("((", 1)
+		}
+	case "#":
+		if l.startsWord(state, l.Current-1) {
+			l.matchComment()
+		}
+	case "<":
+		if l.peek() == "<" {
+			l.nextScriptChar()
+			if l.peek() == "<" {
+				// a here-string rather than a heredoc
+				l.nextScriptChar()
+				return nil
+			}
+			l.readHeredoc(state)
+		}
+	case "{":
+		state.braces++
+	case "}":
+		state.braces--
+	}
+	return nil
+}
+
+func (l *Lexer) nextScriptChar() string {
+	if l.isAtEnd() {
+		return ""
+	}
+	char := l.nextChar()
+	if char == "\n" {
+		l.Line++
+	}
+	return char
+}
+
+// a # only starts a comment at the start of a word, e.g. not in $# or ${#list[@]}
+func (l *Lexer) startsWord(state *scriptState, position int) bool {
+	if position <= state.start {
+		return true
+	}
+	return strings.ContainsAny(string(l.Input[position-1]), " \t\n;|&(")
+}
+
+// skips to the end of a '...' or `...` string
+func (l *Lexer) skipQuoted(delimiter string, escapes bool) error {
+	line := l.Line
+	for !l.isAtEnd() {
+		char := l.nextScriptChar()
+		if char == "\\" && escapes {
+			l.nextScriptChar()
+		} else if char == delimiter {
+			return nil
+		}
+	}
+	return l.errorAt(line, delimiter, "script has an unclosed quote")
+}
+
+// skips to the end of a "..." string, including any $(...) inside it
+func (l *Lexer) skipDoubleQuoted() error {
+	line := l.Line
+	for !l.isAtEnd() {
+		switch l.nextScriptChar() {
+		case "\\":
+			l.nextScriptChar()
+		case "\"":
+			return nil
+		case "`":
+			if err := l.skipQuoted("`", true); err != nil {
+				return err
+			}
+		case "$":
+			if l.peek() == "(" {
+				l.nextScriptChar()
+				if err := l.skipSubshell(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return l.errorAt(line, "\"", "script has an unclosed quote")
+}
+
+// skips to the end of a $(...) inside a "..." string, which is read like a script of its own
+func (l *Lexer) skipSubshell() error {
+	line := l.Line
+	state := &scriptState{start: l.Current}
+	depth := 1
+	for !l.isAtEnd() {
+		switch l.peek() {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				l.nextScriptChar()
+				return nil
+			}
+		}
+		if err := l.scanScript(state); err != nil {
+			return err
+		}
+	}
+	return l.errorAt(line, "$(", "script has an unclosed $(")
+}
+
+// skips $((...)) and ((...)) so that shifts aren't read as heredocs. depth is how many
+// of the opening parentheses have already been read.
+func (l *Lexer) skipArithmetic(opener string, depth int) error {
+	line := l.Line
+	for !l.isAtEnd() {
+		switch l.nextScriptChar() {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return nil
+			}
+		}
+	}
+	return l.errorAt(line, opener, "script has an unclosed "+opener)
+}
+
+// reads the delimiter of a heredoc after its <<, e.g. EOF in <<-'EOF'
+func (l *Lexer) readHeredoc(state *scriptState) {
+	if l.peek() == "-" {
+		l.nextScriptChar()
+	}
+	for l.peek() == " " || l.peek() == "\t" {
+		l.nextScriptChar()
+	}
+	quote := ""
+	if l.peek() == "'" || l.peek() == "\"" {
+		quote = l.nextScriptChar()
+	}
+	begin := l.Current
+	for !l.isAtEnd() && !l.endsDelimiter(quote) {
+		l.nextScriptChar()
+	}
+	delimiter := l.Input[begin:l.Current]
+	if quote != "" && l.peek() == quote {
+		l.nextScriptChar()
+	}
+	// bash allows any word, but a number is more likely to be something like 1 << 2
+	if delimiter == "" || (quote == "" && !isLetter(delimiter[:1]) && delimiter[:1] != "_") {
+		return
+	}
+	state.heredocs = append(state.heredocs, heredoc{delimiter: delimiter, line: l.Line})
+}
+
+func (l *Lexer) endsDelimiter(quote string) bool {
+	if quote != "" {
+		return l.peek() == quote || l.peek() == "\n"
+	}
+	return strings.ContainsAny(l.peek(), " \t\n;|&<>()")
+}
+
+// skips the bodies of heredocs started on the line that just ended
+func (l *Lexer) skipHeredocs(state *scriptState) error {
+	for _, doc := range state.heredocs {
+		for {
+			if l.isAtEnd() {
+				return l.errorAt(doc.line, "<<", fmt.Sprintf("heredoc has no closing %s", doc.delimiter))
+			}
+			begin := l.Current
+			for !l.isAtEnd() && l.peek() != "\n" {
+				l.nextScriptChar()
+			}
+			line := l.Input[begin:l.Current]
+			l.nextScriptChar()
+			// the delimiter can be indented like the rest of the script
+			if strings.TrimSpace(line) == doc.delimiter {
+				break
+			}
+		}
+	}
+	state.heredocs = nil
+	return nil
+}
+
+// the first line of a script in braces follows the brace, so only the rest are dedented
+func dedentScript(script string) string {
+	first, rest, found := strings.Cut(script, "\n")
+	if !found {
+		return script
+	}
+	return first + "\n" + dedent(strings.Split(rest, "\n"))
+}
+
+// dedent strips the indentation every line shares, so scripts can be indented like
+// the rest of the file. Blank lines don't count and are left empty.
+func dedent(lines []string) string {
+	indent := ""
+	found := false
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		leading := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if !found {
+			indent, found = leading, true
+		}
+		for !strings.HasPrefix(leading, indent) {
+			indent = indent[:len(indent)-1]
+		}
+	}
+	dedented := make([]string, len(lines))
+	for index, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			dedented[index] = line[len(indent):]
+		}
+	}
+	return strings.Join(dedented, "\n")
+}
+
+// raw scripts follow run, or a mock's name, in place of a block
+func (l *Lexer) opensRawScript() bool {
+	switch l.Context.current() {
+	case token.RUN:
+		return l.lastToken().Type == token.RUN
+	case token.MOCK:
+		return l.lastToken().Type == token.IDENTIFIER
+	}
+	return false
+}
+
+// matchRawScript reads a script from after <<DELIMITER up to a line with just the
+// delimiter, e.g. run <<EOF. Nothing in it is read by runny, not even braces.
+func (l *Lexer) matchRawScript() error {
+	line := l.Line
+	l.nextChar()
+	quote := ""
+	if l.peek() == "'" || l.peek() == "\"" {
+		quote = l.nextChar()
+	}
+	begin := l.Current
+	for isAlphaNumeric(l.peek()) || l.peek() == "_" {
+		l.nextChar()
+	}
+	delimiter := l.Input[begin:l.Current]
+	if delimiter == "" {
+		return l.errorAt(line, "<<", "expect a delimiter after <<")
+	}
+	if quote != "" {
+		if l.peek() != quote {
+			return l.errorAt(line, "<<", "delimiter has no closing quote")
+		}
+		l.nextChar()
+	}
+	return l.readRawScript(delimiter, line, "<<")
+}
+
+// matchFencedScript reads a script between ``` fences, e.g. run ```sh. Anything after
+// the opening fence, like the language, is ignored.
+func (l *Lexer) matchFencedScript() error {
+	line := l.Line
+	l.nextChar()
+	l.nextChar()
+	for isAlphaNumeric(l.peek()) || isAllowedIdentChar(l.peek()) {
+		l.nextChar()
+	}
+	return l.readRawScript("```", line, "```")
+}
+
+// reads the lines of a raw script up to its closing delimiter, which is left for the
+// lexer so that its line is counted as usual
+func (l *Lexer) readRawScript(delimiter string, line int, ch string) error {
+	for l.peek() == " " || l.peek() == "\t" || l.peek() == "\r" {
+		l.nextChar()
+	}
+	if !l.isAtEnd() && l.peek() != "\n" {
+		return l.errorAt(line, ch, "raw script must start on a new line")
+	}
+	start := l.Current + 1
+	end := start
+	lines := make([]string, 0)
+	for {
+		if l.isAtEnd() {
+			return l.errorAt(line, ch, fmt.Sprintf("script has no closing %s", delimiter))
+		}
+		l.nextChar()
+		l.Line++
+		begin := l.Current
+		for !l.isAtEnd() && l.peek() != "\n" {
+			l.nextChar()
+		}
+		text := strings.TrimSuffix(l.Input[begin:l.Current], "\r")
+		if strings.TrimSpace(text) == delimiter {
+			break
+		}
+		lines = append(lines, text)
+		end = l.Current
+	}
+	l.addToken(token.SCRIPT, dedent(lines), withPosition(start, line+1, l.Depth), withSpan(start, end))
+	// there's no closing brace to end the block
+	l.Context.resetContext()
+	return nil
+}
@@ -0,0 +1,266 @@
+// Package loader reads a runny file, and every file it extends or imports,
+// into one tree before anything is run.
+package loader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runny/src/fetch"
+	"runny/src/lex"
+	"runny/src/parser"
+	"runny/src/token"
+	"runny/src/trace"
+	"runny/src/tree"
+	"runny/src/value"
+	"sort"
+	"strings"
+)
+
+func New(fsys fs.FS, fetcher *fetch.Fetcher) *Loader {
+	return &Loader{
+		FS:      fsys,
+		Fetcher: fetcher,
+	}
+}
+
+type Loader struct {
+	FS       fs.FS          // where files are read from, the os filesystem if nil
+	Fetcher  *fetch.Fetcher // downloads remote files, they're unsupported if nil
+	Warnings []string       // problems that don't stop files loading e.g. conflicting names
+}
+
+// TokenError is returned when a file can't be lexed. Tokens are those of the statement
+// being parsed when it happened.
+type TokenError struct {
+	Err    error
+	Tokens []token.Token
+}
+
+func (te *TokenError) Error() string {
+	return te.Err.Error()
+}
+
+func (te *TokenError) Unwrap() error {
+	return te.Err
+}
+
+// Load parses file and fills in the files its extends and import statements refer to
+func (l *Loader) Load(ctx context.Context, file string) ([]tree.Statement, error) {
+	return l.load(ctx, file, nil)
+}
+
+func (l *Loader) load(ctx context.Context, file string, parents []string) (statements []tree.Statement, err error) {
+	ctx, span := trace.Start(ctx, "load", l.displayPath(file))
+	defer func() {
+		span.Fail(err)
+		span.Finish()
+	}()
+
+	statements, err = l.parse(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	parents = append(append([]string{}, parents...), file)
+	extended := make(map[string]string)
+	for index, statement := range statements {
+		switch typed := statement.(type) {
+		case tree.ExtendsStatement:
+			typed.Files = make([]tree.File, 0, len(typed.Paths))
+			for _, path := range typed.Paths {
+				included, err := l.include(ctx, "extends", file, path, parents)
+				if err != nil {
+					return nil, err
+				}
+				l.checkConflicts(extended, *included)
+				typed.Files = append(typed.Files, *included)
+			}
+			statements[index] = typed
+		case tree.ImportStatement:
+			included, err := l.include(ctx, "import", file, typed.Path, parents)
+			if err != nil {
+				return nil, err
+			}
+			typed.File = included
+			statements[index] = typed
+		}
+	}
+	return statements, nil
+}
+
+// loads a file that's extended or imported by another. keyword is the statement including it.
+func (l *Loader) include(ctx context.Context, keyword string, from string, path tree.Expression, parents []string) (_ *tree.File, err error) {
+	literal, isLiteral := path.(tree.Literal)
+	pathStr, isString := literal.Value.(value.String)
+	if !isLiteral || !isString {
+		return nil, fmt.Errorf("%s: extends and import paths must be strings", l.displayPath(from))
+	}
+
+	ctx, span := trace.Start(ctx, keyword, keyword+" "+string(pathStr), "from", l.displayPath(from))
+	defer func() {
+		span.Fail(err)
+		span.Finish()
+	}()
+
+	file, err := l.resolve(ctx, from, string(pathStr))
+	if err != nil {
+		return nil, err
+	}
+	if err := l.checkCircular(keyword, file, parents); err != nil {
+		return nil, err
+	}
+
+	statements, err := l.load(ctx, file, parents)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the file runny was started with runs anything by itself
+	included := &tree.File{
+		Path:       file,
+		Statements: make([]tree.Statement, 0, len(statements)),
+	}
+	for _, statement := range statements {
+		if _, isRun := statement.(tree.RunStatement); isRun {
+			included.Skipped = append(included.Skipped, statement)
+			continue
+		}
+		included.Statements = append(included.Statements, statement)
+	}
+	return included, nil
+}
+
+// finds the file a path refers to, fetching it if it's remote.
+// relative paths are relative to the file they're extended from.
+func (l *Loader) resolve(ctx context.Context, from string, path string) (string, error) {
+	source := path
+	if origin, isRemote := l.Fetcher.Source(from); isRemote {
+		source = fetch.Resolve(origin, path)
+	}
+	if !fetch.IsRemote(source) {
+		return filepath.Join(filepath.Dir(from), path), nil
+	}
+	if l.Fetcher == nil {
+		return "", fmt.Errorf("cannot extend %s, remote files are not supported here", source)
+	}
+	_, span := trace.Start(ctx, "fetch", source)
+	defer span.Finish()
+	file, err := l.Fetcher.Fetch(ctx, source)
+	span.Fail(err)
+	return file, err
+}
+
+func (l *Loader) parse(ctx context.Context, file string) ([]tree.Statement, error) {
+	_, span := trace.Start(ctx, "load", "read")
+	contents, err := l.readFile(file)
+	span.Fail(err)
+	span.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	// tokens are lexed as the parser needs them, so one span covers both. The whole
+	// file is still parsed before anything runs, as extends and imports are loaded first.
+	_, span = trace.Start(ctx, "load", "lex and parse")
+	defer span.Finish()
+	lexer := lex.New()
+	lexer.File = l.displayPath(file)
+	lexer.Input = string(contents)
+	fileParser := parser.New()
+	statements, err := fileParser.ParseSource(lexer)
+	span.Fail(err)
+	var lexErr *lex.LexError
+	if errors.As(err, &lexErr) {
+		return nil, &TokenError{Err: err, Tokens: fileParser.Tokens}
+	}
+	return statements, err
+}
+
+func (l *Loader) readFile(file string) ([]byte, error) {
+	// remote files are always cached on disk
+	if _, isRemote := l.Fetcher.Source(file); l.FS != nil && !isRemote {
+		return fs.ReadFile(l.FS, filepath.ToSlash(filepath.Clean(file)))
+	}
+	return os.ReadFile(file)
+}
+
+// errors if file is already being extended or imported further up the chain.
+// keyword is the statement that includes it again.
+func (l *Loader) checkCircular(keyword string, file string, parents []string) error {
+	for index, parent := range parents {
+		if filepath.Clean(parent) != filepath.Clean(file) {
+			continue
+		}
+		files := make([]string, 0, len(parents)-index+1)
+		for _, chained := range append(parents[index:len(parents):len(parents)], file) {
+			files = append(files, l.displayPath(chained))
+		}
+		return fmt.Errorf("circular %s: %s", keyword, strings.Join(files, " -> "))
+	}
+	return nil
+}
+
+// warns if an extended file defines a name that an earlier extended file already has.
+// extended maps each name defined so far to the file it came from.
+func (l *Loader) checkConflicts(extended map[string]string, included tree.File) {
+	defined := definitions(included)
+	names := make([]string, 0, len(defined))
+	for name := range defined {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file := defined[name]
+		if previous, ok := extended[name]; ok && previous != file {
+			l.Warnings = append(l.Warnings, fmt.Sprintf(
+				"%s is defined in both %s and %s, using %s",
+				name, l.displayPath(previous), l.displayPath(file), l.displayPath(file),
+			))
+		}
+		extended[name] = file
+	}
+}
+
+// the top-level variables and targets a file defines, including those it extends
+func definitions(file tree.File) map[string]string {
+	defined := make(map[string]string)
+	for _, statement := range file.Statements {
+		if extends, isExtends := statement.(tree.ExtendsStatement); isExtends {
+			for _, extended := range extends.Files {
+				for name, from := range definitions(extended) {
+					defined[name] = from
+				}
+			}
+		}
+	}
+	for _, statement := range file.Statements {
+		switch typed := statement.(type) {
+		case tree.VariableStatement:
+			for _, variable := range typed.Items {
+				defined[fmt.Sprintf("variable '%s'", variable.Name.Text)] = file.Path
+			}
+		case tree.TargetStatement:
+			defined[fmt.Sprintf("target '%s'", typed.Name.Text)] = file.Path
+		}
+	}
+	return defined
+}
+
+// remote files are shown by where they came from, local files relative to the working directory
+func (l *Loader) displayPath(file string) string {
+	if source, isRemote := l.Fetcher.Source(file); isRemote {
+		return source
+	}
+	if filepath.IsAbs(file) {
+		if wd, err := os.Getwd(); err == nil {
+			if relative, err := filepath.Rel(wd, file); err == nil && !strings.HasPrefix(relative, "..") {
+				return relative
+			}
+		}
+	}
+	return file
+}
@@ -0,0 +1,87 @@
+package loader
+
+import (
+	"context"
+	"runny/src/tree"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoader_Load(t *testing.T) {
+	fsys := fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+extends { "lib/base.rny" }
+run build
+`)},
+		"lib/base.rny": {Data: []byte(`
+extends { "common.rny" }
+target build { run { echo "build" } }
+run { echo "not run" }
+`)},
+		"lib/common.rny": {Data: []byte(`target test { run { echo "test" } }`)},
+		"broken.rny":     {Data: []byte(`extends { "lib/broken.rny" }`)},
+		"lib/broken.rny": {Data: []byte("\n\nvar { name }")},
+		"dynamic.rny":    {Data: []byte(`extends { $file }`)},
+		"cycle.rny":      {Data: []byte(`extends { "lib/cycle.rny" }`)},
+		"lib/cycle.rny":  {Data: []byte(`extends { "../cycle.rny" }`)},
+	}
+
+	t.Run("extended files are loaded into the tree", func(t *testing.T) {
+		statements, err := New(fsys, nil).Load(context.Background(), "runny.rny")
+		assert.NoError(t, err)
+		assert.Len(t, statements, 2)
+
+		extends := statements[0].(tree.ExtendsStatement)
+		assert.Len(t, extends.Files, 1)
+		base := extends.Files[0]
+		assert.Equal(t, "lib/base.rny", base.Path)
+		// top-level runs only happen in the file runny was started with
+		assert.Len(t, base.Statements, 2)
+		assert.Len(t, base.Skipped, 1)
+
+		target := base.Statements[1].(tree.TargetStatement)
+		assert.Equal(t, "lib/base.rny", target.Name.File)
+		assert.Equal(t, 3, target.Name.Line)
+
+		common := base.Statements[0].(tree.ExtendsStatement).Files[0]
+		assert.Equal(t, "lib/common.rny", common.Path)
+	})
+	t.Run("errors say which file they're in", func(t *testing.T) {
+		_, err := New(fsys, nil).Load(context.Background(), "broken.rny")
+		assert.EqualError(t, err, "[lib/broken.rny:3] parse error at '}': expect expression\n")
+	})
+	t.Run("paths must be strings", func(t *testing.T) {
+		_, err := New(fsys, nil).Load(context.Background(), "dynamic.rny")
+		assert.EqualError(t, err, "dynamic.rny: extends and import paths must be strings")
+	})
+	t.Run("circular extends", func(t *testing.T) {
+		_, err := New(fsys, nil).Load(context.Background(), "cycle.rny")
+		assert.EqualError(t, err, "circular extends: cycle.rny -> lib/cycle.rny -> cycle.rny")
+	})
+	t.Run("missing files", func(t *testing.T) {
+		_, err := New(fsys, nil).Load(context.Background(), "missing.rny")
+		assert.Error(t, err)
+	})
+}
+
+func TestLoader_Conflicts(t *testing.T) {
+	fsys := fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+extends { "a.rny", "b.rny" }
+target build { run { echo "mine" } }
+`)},
+		"a.rny": {Data: []byte(`
+target build { run { echo "a" } }
+target test { run { echo "a" } }
+`)},
+		"b.rny": {Data: []byte(`extends { "c.rny" }`)},
+		"c.rny": {Data: []byte(`target test { run { echo "c" } }`)},
+	}
+	loader := New(fsys, nil)
+	_, err := loader.Load(context.Background(), "runny.rny")
+	assert.NoError(t, err)
+	// the extending file's own build target doesn't conflict
+	assert.Equal(t, []string{"target 'test' is defined in both a.rny and c.rny, using c.rny"}, loader.Warnings)
+}
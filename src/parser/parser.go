@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"runny/src/token"
 	"runny/src/tree"
+	"runny/src/value"
+	"strconv"
+	"strings"
 )
 
 func New() *Parser {
@@ -15,14 +18,32 @@ func New() *Parser {
 }
 
 type Parser struct {
-	Tokens     []token.Token
+	Tokens     []token.Token // all of them if given to Parse, or those of the statement being read from a source
 	Current    int
 	Depth      int
 	Statements []tree.Statement
+	source     Source
+	within     []int // where each declaration being parsed starts in Tokens
+}
+
+// Source gives the parser tokens as it needs them, like a lexer reading a file
+type Source interface {
+	Next() (token.Token, error)
 }
 
 func (p *Parser) Parse(tokens []token.Token) (statements []tree.Statement, err error) {
 	p.Tokens = tokens
+	return p.parse()
+}
+
+// ParseSource reads tokens from source only as statements need them. An error
+// from the source stops the parse and is returned as a SourceError.
+func (p *Parser) ParseSource(source Source) (statements []tree.Statement, err error) {
+	p.source = source
+	return p.parse()
+}
+
+func (p *Parser) parse() (statements []tree.Statement, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			if str, ok := r.(string); ok {
@@ -35,17 +56,35 @@ func (p *Parser) Parse(tokens []token.Token) (statements []tree.Statement, err e
 		}
 	}()
 	for !p.isAtEnd() {
+		p.release()
 		p.Statements = append(p.Statements, p.declaration())
 	}
 	statements = p.Statements
 	return
 }
 
+// tokens before the previous one are never looked at again, so a parse from a source
+// only holds on to those of the statement it's reading
+func (p *Parser) release() {
+	if p.source == nil || p.Current < 2 {
+		return
+	}
+	p.Tokens = p.Tokens[:copy(p.Tokens, p.Tokens[p.Current-1:])]
+	p.Current = 1
+}
+
 func (p *Parser) declaration() tree.Statement {
+	p.within = append(p.within, p.Current)
+	defer func() {
+		p.within = p.within[:len(p.within)-1]
+	}()
+
 	if p.match(token.CONFIG) {
 		return p.configDeclaration()
-	} else if p.match(token.VAR) {
-		return p.varDeclaration()
+	} else if p.check(token.VAR) {
+		modifier := p.peek().Modifier
+		p.advance()
+		return p.varDeclaration(modifier)
 	} else if p.match(token.TARGET) {
 		return p.targetDeclaration()
 	} else if p.check(token.RUN) { // this feels hacky
@@ -56,6 +95,22 @@ func (p *Parser) declaration() tree.Statement {
 		return p.describeDeclaration()
 	} else if p.match(token.EXTENDS) {
 		return p.extendsDeclaration()
+	} else if p.match(token.IMPORT) {
+		return p.importDeclaration()
+	} else if p.match(token.ENV) {
+		return p.envDeclaration()
+	} else if p.match(token.IF) {
+		return p.ifDeclaration()
+	} else if p.check(token.FOR) {
+		modifier := p.peek().Modifier
+		p.advance()
+		return p.forDeclaration(modifier)
+	} else if p.match(token.TEST) {
+		return p.testDeclaration()
+	} else if p.match(token.MOCK) {
+		return p.mockDeclaration()
+	} else if p.check(token.EXPECT) {
+		return p.expectStatement()
 	} else if p.check(token.SCRIPT) {
 		return p.actionStatement()
 	}
@@ -63,6 +118,7 @@ func (p *Parser) declaration() tree.Statement {
 }
 
 func (p *Parser) configDeclaration() tree.Statement {
+	start := p.previous()
 	p.consume(token.LEFT_BRACE, "expect left brace")
 
 	depth := p.increaseDepth()
@@ -72,13 +128,17 @@ func (p *Parser) configDeclaration() tree.Statement {
 	}
 
 	for !p.isAtEnd() {
-		name := p.consume(token.IDENTIFIER, "expect config variable")
-		initialiser := p.declaration()
+		if p.match(token.ENV) {
+			configDecl.Env = append(configDecl.Env, p.envDeclaration().(tree.EnvStatement))
+		} else {
+			name := p.consume(token.IDENTIFIER, "expect config variable")
+			initialiser := p.declaration()
 
-		configDecl.Items = append(configDecl.Items, tree.Config{
-			Name:        name,
-			Initialiser: initialiser,
-		})
+			configDecl.Items = append(configDecl.Items, tree.Config{
+				Name:        name,
+				Initialiser: initialiser,
+			})
+		}
 
 		if p.check(token.COMMA) {
 			p.advance()
@@ -93,32 +153,28 @@ func (p *Parser) configDeclaration() tree.Statement {
 
 	p.reduceDepth()
 
+	configDecl.Node = p.node(start)
+
 	return configDecl
 }
 
-func (p *Parser) varDeclaration() tree.Statement {
+func (p *Parser) varDeclaration(modifier *token.TokenModifier) tree.Statement {
+	start := p.previous()
 	p.consume(token.LEFT_BRACE, "expect left brace")
 
 	depth := p.increaseDepth()
 
 	varDecl := tree.VariableStatement{
-		Items: make([]tree.Variable, 0),
+		Items:  make([]tree.Variable, 0),
+		Secret: modifier != nil && *modifier == token.SECRET,
 	}
 
 	for !p.isAtEnd() {
 		name := p.consume(token.IDENTIFIER, "expect variable name")
 
-		var initialiser tree.Statement
-		if p.match(token.LEFT_BRACE) {
-			initialiser = p.declaration() // var is the output of an evaluated block e.g. var name { run { echo "tim" } }
-			p.consume(token.RIGHT_BRACE, "expect right brace")
-		} else {
-			initialiser = p.declaration()
-		}
-
 		varDecl.Items = append(varDecl.Items, tree.Variable{
 			Name:        name,
-			Initialiser: initialiser,
+			Initialiser: p.initialiser(),
 		})
 
 		if p.check(token.COMMA) {
@@ -134,10 +190,59 @@ func (p *Parser) varDeclaration() tree.Statement {
 
 	p.reduceDepth()
 
+	varDecl.Node = p.node(start)
+
 	return varDecl
 }
 
+// the value of a variable or environment variable
+func (p *Parser) initialiser() tree.Statement {
+	if p.check(token.LEFT_BRACE) && !p.isMapStart() {
+		p.advance()
+		initialiser := p.declaration() // the output of an evaluated block e.g. var name { run { echo "tim" } }
+		p.consume(token.RIGHT_BRACE, "expect right brace")
+		return initialiser
+	}
+	return p.declaration()
+}
+
+func (p *Parser) envDeclaration() tree.Statement {
+	start := p.previous()
+	p.consume(token.LEFT_BRACE, "expect left brace")
+
+	depth := p.increaseDepth()
+
+	envDecl := tree.EnvStatement{
+		Items: make([]tree.Variable, 0),
+	}
+
+	for !p.isAtEnd() {
+		name := p.consume(token.IDENTIFIER, "expect environment variable name")
+		envDecl.Items = append(envDecl.Items, tree.Variable{
+			Name:        name,
+			Initialiser: p.initialiser(),
+		})
+
+		if p.check(token.COMMA) {
+			p.advance()
+		}
+
+		if p.check(token.RIGHT_BRACE) && depth == p.Depth {
+			break
+		}
+	}
+
+	p.consume(token.RIGHT_BRACE, "expect right brace")
+
+	p.reduceDepth()
+
+	envDecl.Node = p.node(start)
+
+	return envDecl
+}
+
 func (p *Parser) targetDeclaration() tree.Statement {
+	start := p.previous()
 	name := p.consume(token.IDENTIFIER, "expect target name")
 
 	p.consume(token.LEFT_BRACE, "expect left brace")
@@ -162,12 +267,34 @@ func (p *Parser) targetDeclaration() tree.Statement {
 
 	p.reduceDepth()
 
+	targetDecl.Node = p.node(start)
+
 	return targetDecl
 }
 
 func (p *Parser) runDeclaration(modifier *token.TokenModifier) tree.Statement {
+	start := p.previous()
 	runDecl := tree.RunStatement{
-		Body: make([]tree.Statement, 0),
+		Body:  make([]tree.Statement, 0),
+		Stage: tree.DURING,
+	}
+
+	if modifier != nil {
+		switch *modifier {
+		case token.BEFORE:
+			runDecl.Stage = tree.BEFORE
+		case token.AFTER:
+			runDecl.Stage = tree.AFTER
+		case token.SILENT:
+			runDecl.Silent = true
+		}
+	}
+
+	// a raw script e.g. run <<EOF has no block around it
+	if p.check(token.SCRIPT) {
+		runDecl.Body = append(runDecl.Body, p.actionStatement())
+		runDecl.Node = p.node(start)
+		return runDecl
 	}
 
 	if p.check(token.IDENTIFIER) {
@@ -175,6 +302,7 @@ func (p *Parser) runDeclaration(modifier *token.TokenModifier) tree.Statement {
 		runDecl.Name = name
 
 		if !p.check(token.LEFT_BRACE) {
+			runDecl.Node = p.node(start)
 			return runDecl
 		}
 	}
@@ -192,23 +320,15 @@ func (p *Parser) runDeclaration(modifier *token.TokenModifier) tree.Statement {
 
 	p.consume(token.RIGHT_BRACE, "expect right brace")
 
-	if modifier != nil {
-		switch *modifier {
-		case token.BEFORE:
-			runDecl.Stage = tree.BEFORE
-		case token.AFTER:
-			runDecl.Stage = tree.AFTER
-		}
-	} else {
-		runDecl.Stage = tree.DURING
-	}
-
 	p.reduceDepth()
 
+	runDecl.Node = p.node(start)
+
 	return runDecl
 }
 
 func (p *Parser) describeDeclaration() tree.Statement {
+	start := p.previous()
 	p.consume(token.LEFT_BRACE, "expect left brace")
 
 	depth := p.increaseDepth()
@@ -221,9 +341,11 @@ func (p *Parser) describeDeclaration() tree.Statement {
 		initialiser := p.declaration()
 
 		var value interface{}
+		var node tree.Node
 		if statement, ok := initialiser.(tree.ExpressionStatement); ok {
 			if literal, ok := statement.Expression.(tree.Literal); ok {
 				value = literal.Value
+				node = literal.Node
 			}
 		}
 
@@ -232,6 +354,7 @@ func (p *Parser) describeDeclaration() tree.Statement {
 		}
 
 		descDecl.Lines = append(descDecl.Lines, tree.Literal{
+			Node:  node,
 			Value: value,
 		})
 
@@ -248,10 +371,13 @@ func (p *Parser) describeDeclaration() tree.Statement {
 
 	p.reduceDepth()
 
+	descDecl.Node = p.node(start)
+
 	return descDecl
 }
 
 func (p *Parser) extendsDeclaration() tree.Statement {
+	start := p.previous()
 	p.consume(token.LEFT_BRACE, "expect left brace")
 
 	depth := p.increaseDepth()
@@ -274,35 +400,292 @@ func (p *Parser) extendsDeclaration() tree.Statement {
 
 	p.reduceDepth()
 
+	extends.Node = p.node(start)
+
 	return extends
 }
 
+func (p *Parser) importDeclaration() tree.Statement {
+	start := p.previous()
+	importDecl := tree.ImportStatement{
+		Path: p.expression(),
+	}
+
+	p.consume(token.AS, "expect 'as' after import path")
+
+	alias := p.consume(token.IDENTIFIER, "expect import name")
+	if strings.ContainsAny(alias.Text, ".:$") {
+		panic(p.error(alias, "import name cannot contain '.', ':' or '$'"))
+	}
+	importDecl.Alias = alias
+	importDecl.Node = p.node(start)
+
+	return importDecl
+}
+
+func (p *Parser) ifDeclaration() tree.Statement {
+	start := p.previous()
+	ifDecl := tree.IfStatement{
+		Condition: p.expression(),
+		Then:      p.block(),
+	}
+
+	if p.match(token.ELSE) {
+		if p.match(token.IF) {
+			ifDecl.Else = []tree.Statement{p.ifDeclaration()}
+		} else {
+			ifDecl.Else = p.block()
+		}
+	}
+	ifDecl.Node = p.node(start)
+
+	return ifDecl
+}
+
+func (p *Parser) forDeclaration(modifier *token.TokenModifier) tree.Statement {
+	start := p.previous()
+	name := p.consume(token.IDENTIFIER, "expect loop variable name")
+
+	p.consume(token.IN, "expect 'in' after loop variable")
+
+	forDecl := tree.ForStatement{
+		Name:     name,
+		Iterable: p.expression(),
+		Body:     p.block(),
+		Parallel: modifier != nil && *modifier == token.PARALLEL,
+	}
+	forDecl.Node = p.node(start)
+
+	return forDecl
+}
+
+func (p *Parser) testDeclaration() tree.Statement {
+	start := p.previous()
+	name := p.consume(token.STRING, "expect test name")
+	name.Text = unquote(name.Text)
+
+	testDecl := tree.TestStatement{
+		Name: name,
+		Body: p.block(),
+	}
+	testDecl.Node = p.node(start)
+
+	return testDecl
+}
+
+func (p *Parser) mockDeclaration() tree.Statement {
+	start := p.previous()
+	name := p.consume(token.IDENTIFIER, "expect command name")
+	if strings.ContainsAny(name.Text, "/$:") {
+		panic(p.error(name, "command name cannot contain '/', '$' or ':'"))
+	}
+
+	mockDecl := tree.MockStatement{
+		Name: name,
+	}
+	if p.check(token.SCRIPT) {
+		mockDecl.Body = p.advance()
+		mockDecl.Node = p.node(start)
+		return mockDecl
+	}
+	p.consume(token.LEFT_BRACE, "expect left brace")
+	if p.check(token.SCRIPT) {
+		mockDecl.Body = p.advance()
+	}
+	p.consume(token.RIGHT_BRACE, "expect right brace")
+	mockDecl.Node = p.node(start)
+
+	return mockDecl
+}
+
+func (p *Parser) expectStatement() tree.Statement {
+	start := p.peek()
+	expectStmt := tree.ExpectStatement{
+		Keyword: p.advance(),
+		Subject: p.consume(token.IDENTIFIER, "expect output, stdout, stderr or exit"),
+	}
+
+	switch expectStmt.Subject.Text {
+	case "exit":
+	case "output", "stdout", "stderr":
+		expectStmt.Operator = p.consume(token.IDENTIFIER, "expect contains, equals or matches")
+		switch expectStmt.Operator.Text {
+		case "contains", "equals", "matches":
+		default:
+			panic(p.error(expectStmt.Operator, "expect contains, equals or matches"))
+		}
+	default:
+		panic(p.error(expectStmt.Subject, "expect output, stdout, stderr or exit"))
+	}
+	expectStmt.Expected = p.expression()
+	expectStmt.Node = p.node(start)
+
+	return expectStmt
+}
+
+// a list of statements surrounded by braces
+func (p *Parser) block() []tree.Statement {
+	p.consume(token.LEFT_BRACE, "expect left brace")
+
+	p.increaseDepth()
+
+	statements := make([]tree.Statement, 0)
+	for !p.isAtEnd() && !p.check(token.RIGHT_BRACE) {
+		statements = append(statements, p.declaration())
+	}
+
+	p.consume(token.RIGHT_BRACE, "expect right brace")
+
+	p.reduceDepth()
+
+	return statements
+}
+
 func (p *Parser) actionStatement() tree.Statement {
 	script := p.consume(token.SCRIPT, "expect action body")
 
 	return tree.ActionStatement{
+		Node: p.node(script),
 		Body: script,
 	}
 }
 
 func (p *Parser) expressionStatement() tree.Statement {
+	start := p.peek()
 	exprstatement := tree.ExpressionStatement{
 		Expression: p.expression(),
 	}
+	exprstatement.Node = p.node(start)
 	return exprstatement
 }
 
 func (p *Parser) expression() tree.Expression {
-	if p.match(token.NUMBER, token.STRING) {
-		return tree.Literal{Value: p.previous().Text}
+	start := p.peek()
+	if p.match(token.NUMBER) {
+		number, err := strconv.ParseFloat(p.previous().Text, 64)
+		if err != nil {
+			panic(p.error(p.previous(), "invalid number"))
+		}
+		return tree.Literal{Node: p.node(start), Value: value.Number(number)}
+	}
+	if p.match(token.STRING) {
+		return tree.Literal{Node: p.node(start), Value: value.String(unquote(p.previous().Text))}
+	}
+	if p.match(token.TRUE) {
+		return tree.Literal{Node: p.node(start), Value: value.Bool(true)}
+	}
+	if p.match(token.FALSE) {
+		return tree.Literal{Node: p.node(start), Value: value.Bool(false)}
+	}
+	if p.match(token.LEFT_BRACKET) {
+		return p.list(start)
+	}
+	if p.match(token.LEFT_BRACE) {
+		return p.mapExpression(start)
 	}
 	if p.match(token.IDENTIFIER) {
-		return tree.Literal{Value: p.previous().Text}
+		identifier := p.previous()
+		if len(identifier.Text) > 1 && strings.HasPrefix(identifier.Text, "$") {
+			identifier.Text = identifier.Text[1:]
+			return tree.Reference{Node: p.node(start), Name: identifier}
+		}
+		if p.match(token.LEFT_PAREN) {
+			return p.call(start, identifier)
+		}
+		return tree.Literal{Node: p.node(start), Value: value.String(identifier.Text)}
 	}
 
 	panic(p.error(p.peek(), "expect expression"))
 }
 
+func (p *Parser) list(start token.Token) tree.Expression {
+	list := tree.List{
+		Items: make([]tree.Expression, 0),
+	}
+
+	for !p.isAtEnd() && !p.check(token.RIGHT_BRACKET) {
+		list.Items = append(list.Items, p.expression())
+
+		if !p.match(token.COMMA) {
+			break
+		}
+	}
+
+	p.consume(token.RIGHT_BRACKET, "expect right bracket")
+	list.Node = p.node(start)
+
+	return list
+}
+
+func (p *Parser) call(start token.Token, callee token.Token) tree.Expression {
+	call := tree.Call{
+		Callee:    callee,
+		Arguments: make([]tree.Expression, 0),
+	}
+
+	for !p.isAtEnd() && !p.check(token.RIGHT_PAREN) {
+		call.Arguments = append(call.Arguments, p.expression())
+
+		if !p.match(token.COMMA) {
+			break
+		}
+	}
+
+	p.consume(token.RIGHT_PAREN, "expect right parenthesis after arguments")
+	call.Node = p.node(start)
+
+	return call
+}
+
+func (p *Parser) mapExpression(start token.Token) tree.Expression {
+	mapExpr := tree.Map{
+		Items: make([]tree.MapItem, 0),
+	}
+
+	for !p.isAtEnd() && !p.check(token.RIGHT_BRACE) {
+		key := p.consume(token.IDENTIFIER, "expect map key")
+		mapExpr.Items = append(mapExpr.Items, tree.MapItem{
+			Key:   key,
+			Value: p.expression(),
+		})
+
+		p.match(token.COMMA)
+	}
+
+	p.consume(token.RIGHT_BRACE, "expect right brace")
+	mapExpr.Node = p.node(start)
+
+	return mapExpr
+}
+
+// a brace followed by a key or another brace is a map rather than a block
+func (p *Parser) isMapStart() bool {
+	if !p.fill(p.Current + 1) {
+		return false
+	}
+	next := p.Tokens[p.Current+1].Type
+	return next == token.IDENTIFIER || next == token.RIGHT_BRACE
+}
+
+// a node spanning from start to the last token read
+func (p *Parser) node(start token.Token) tree.Node {
+	return tree.Node{
+		Span: token.Span{
+			File:  start.Span.File,
+			Start: start.Span.Start,
+			End:   p.previous().Span.End,
+		},
+	}
+}
+
+// string tokens keep their quotes from the lexer
+func unquote(text string) string {
+	if len(text) >= 2 && strings.HasPrefix(text, "\"") && strings.HasSuffix(text, "\"") {
+		return text[1 : len(text)-1]
+	}
+	return text
+}
+
 // check that the current token is any of the types and advance if so
 func (p *Parser) match(tokenTypes ...token.TokenType) bool {
 	for _, tokenType := range tokenTypes {
@@ -336,9 +719,25 @@ func (p *Parser) previous() token.Token {
 
 // get the token at the current index
 func (p *Parser) peek() token.Token {
+	p.fill(p.Current)
 	return p.Tokens[p.Current]
 }
 
+// reads tokens from the source until there's one at index, returning whether there is
+func (p *Parser) fill(index int) bool {
+	for p.source != nil && index >= len(p.Tokens) {
+		if len(p.Tokens) > 0 && p.Tokens[len(p.Tokens)-1].Type == token.EOF {
+			break
+		}
+		next, err := p.source.Next()
+		if err != nil {
+			panic(&SourceError{Err: err, While: p.parsing()})
+		}
+		p.Tokens = append(p.Tokens, next)
+	}
+	return index < len(p.Tokens)
+}
+
 // if the token is of the specified type advance, otherwise panic
 func (p *Parser) consume(tokenType token.TokenType, message string) token.Token {
 	if p.check(tokenType) {
@@ -362,6 +761,60 @@ func (p *Parser) isAtEnd() bool {
 	return p.peek().Type == token.EOF
 }
 
+// SourceError is an error reading tokens from a source, like a lex error, along with what
+// was being parsed when it happened
+type SourceError struct {
+	Err   error
+	While string // e.g. "run in target build", empty between statements
+}
+
+func (se *SourceError) Error() string {
+	message := se.Err.Error()
+	if se.While == "" {
+		return message
+	}
+	trimmed := strings.TrimSuffix(message, "\n")
+	return trimmed + ", while parsing " + se.While + message[len(trimmed):]
+}
+
+func (se *SourceError) Unwrap() error {
+	return se.Err
+}
+
+// the declarations that start with a keyword, which describe where the parser is
+var keywords = map[token.TokenType]bool{
+	token.CONFIG:   true,
+	token.VAR:      true,
+	token.TARGET:   true,
+	token.RUN:      true,
+	token.DESCRIBE: true,
+	token.EXTENDS:  true,
+	token.IMPORT:   true,
+	token.ENV:      true,
+	token.IF:       true,
+	token.FOR:      true,
+	token.TEST:     true,
+	token.MOCK:     true,
+	token.EXPECT:   true,
+}
+
+// describes the declarations being parsed, innermost first e.g. "run in target build"
+func (p *Parser) parsing() string {
+	var described []string
+	for i := len(p.within) - 1; i >= 0; i-- {
+		start := p.within[i]
+		if start >= len(p.Tokens) || !keywords[p.Tokens[start].Type] {
+			continue
+		}
+		description := p.Tokens[start].Text
+		if start+1 < len(p.Tokens) && p.Tokens[start+1].Type == token.IDENTIFIER {
+			description += " " + p.Tokens[start+1].Text
+		}
+		described = append(described, description)
+	}
+	return strings.Join(described, " in ")
+}
+
 type ParseError struct {
 	Message string
 }
@@ -380,7 +833,7 @@ func (p *Parser) error(thisToken token.Token, message string) *ParseError {
 		where = "at '" + thisToken.Text + "'"
 	}
 	err := &ParseError{
-		Message: fmt.Sprintf("[line %d] parse error %s: %s\n", thisToken.Line, where, message),
+		Message: fmt.Sprintf("[%s] parse error %s: %s\n", token.Location(thisToken.File, thisToken.Line), where, message),
 	}
 	return err
 }
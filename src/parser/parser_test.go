@@ -2,10 +2,14 @@ package parser_test
 
 import (
 	"encoding/json"
+	"errors"
 	"reflect"
+	"runny/src/lex"
 	"runny/src/parser"
 	"runny/src/token"
 	"runny/src/tree"
+	"runny/src/value"
+	"strings"
 	"testing"
 )
 
@@ -37,7 +41,7 @@ func TestStatements(t *testing.T) {
 							{
 								Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
 								Initialiser: tree.ExpressionStatement{
-									Expression: tree.Literal{Value: "Tim"},
+									Expression: tree.Literal{Value: value.String("Tim")},
 								},
 							},
 						},
@@ -64,7 +68,7 @@ func TestStatements(t *testing.T) {
 							{
 								Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
 								Initialiser: tree.ExpressionStatement{
-									Expression: tree.Literal{Value: "Tim"},
+									Expression: tree.Literal{Value: value.String("Tim")},
 								},
 							},
 						},
@@ -166,13 +170,13 @@ func TestStatements(t *testing.T) {
 							{
 								Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
 								Initialiser: tree.ExpressionStatement{
-									Expression: tree.Literal{Value: "Tim"},
+									Expression: tree.Literal{Value: value.String("Tim")},
 								},
 							},
 							{
 								Name: token.Token{Type: token.IDENTIFIER, Text: "foo"},
 								Initialiser: tree.ExpressionStatement{
-									Expression: tree.Literal{Value: "bar"},
+									Expression: tree.Literal{Value: value.String("bar")},
 								},
 							},
 						},
@@ -203,13 +207,13 @@ func TestStatements(t *testing.T) {
 							{
 								Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
 								Initialiser: tree.ExpressionStatement{
-									Expression: tree.Literal{Value: "Tim"},
+									Expression: tree.Literal{Value: value.String("Tim")},
 								},
 							},
 							{
 								Name: token.Token{Type: token.IDENTIFIER, Text: "foo"},
 								Initialiser: tree.ExpressionStatement{
-									Expression: tree.Literal{Value: "bar"},
+									Expression: tree.Literal{Value: value.String("bar")},
 								},
 							},
 						},
@@ -269,7 +273,7 @@ func TestStatements(t *testing.T) {
 									{
 										Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
 										Initialiser: tree.ExpressionStatement{
-											Expression: tree.Literal{Value: "Tim"},
+											Expression: tree.Literal{Value: value.String("Tim")},
 										},
 									},
 								},
@@ -317,7 +321,7 @@ func TestStatements(t *testing.T) {
 									{
 										Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
 										Initialiser: tree.ExpressionStatement{
-											Expression: tree.Literal{Value: "Tim"},
+											Expression: tree.Literal{Value: value.String("Tim")},
 										},
 									},
 								},
@@ -334,7 +338,7 @@ func TestStatements(t *testing.T) {
 									{
 										Name: token.Token{Type: token.IDENTIFIER, Text: "foo"},
 										Initialiser: tree.ExpressionStatement{
-											Expression: tree.Literal{Value: "bar"},
+											Expression: tree.Literal{Value: value.String("bar")},
 										},
 									},
 								},
@@ -411,7 +415,7 @@ func TestStatements(t *testing.T) {
 									{
 										Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
 										Initialiser: tree.ExpressionStatement{
-											Expression: tree.Literal{Value: "tim"},
+											Expression: tree.Literal{Value: value.String("tim")},
 										},
 									},
 								},
@@ -445,7 +449,7 @@ func TestStatements(t *testing.T) {
 							{
 								Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
 								Initialiser: tree.ExpressionStatement{
-									Expression: tree.Literal{Value: "tim"},
+									Expression: tree.Literal{Value: value.String("tim")},
 								},
 							},
 						},
@@ -455,7 +459,7 @@ func TestStatements(t *testing.T) {
 							{
 								Name: token.Token{Type: token.IDENTIFIER, Text: "foo"},
 								Initialiser: tree.ExpressionStatement{
-									Expression: tree.Literal{Value: "bar"},
+									Expression: tree.Literal{Value: value.String("bar")},
 								},
 							},
 						},
@@ -482,7 +486,7 @@ func TestStatements(t *testing.T) {
 							{
 								Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
 								Initialiser: tree.ExpressionStatement{
-									Expression: tree.Literal{Value: "$tim"},
+									Expression: tree.Literal{Value: value.String("$tim")},
 								},
 							},
 						},
@@ -542,7 +546,7 @@ func TestStatements(t *testing.T) {
 									{
 										Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
 										Initialiser: tree.ExpressionStatement{
-											Expression: tree.Literal{Value: "James"},
+											Expression: tree.Literal{Value: value.String("James")},
 										},
 									},
 								},
@@ -600,7 +604,7 @@ func TestStatements(t *testing.T) {
 											{
 												Name: token.Token{Type: token.IDENTIFIER, Text: "LAMBDA"},
 												Initialiser: tree.ExpressionStatement{
-													Expression: tree.Literal{Value: "list-id-providers"},
+													Expression: tree.Literal{Value: value.String("list-id-providers")},
 												},
 											},
 										},
@@ -615,7 +619,7 @@ func TestStatements(t *testing.T) {
 											{
 												Name: token.Token{Type: token.IDENTIFIER, Text: "LAMBDA"},
 												Initialiser: tree.ExpressionStatement{
-													Expression: tree.Literal{Value: "post-auth"},
+													Expression: tree.Literal{Value: value.String("post-auth")},
 												},
 											},
 										},
@@ -650,7 +654,52 @@ func TestStatements(t *testing.T) {
 								},
 								Initialiser: tree.ExpressionStatement{
 									Expression: tree.Literal{
-										Value: "/bin/bash",
+										Value: value.String("/bin/bash"),
+									},
+								},
+							},
+						},
+					},
+				}
+			},
+		},
+		{
+			name: "config with env",
+			tokens: func() []token.Token {
+				return []token.Token{
+					{Type: token.CONFIG, Text: "config"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.ENV, Text: "env"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "CI"},
+					{Type: token.STRING, Text: "\"true\""},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.COMMA, Text: ","},
+					{Type: token.IDENTIFIER, Text: "clear_env"},
+					{Type: token.TRUE, Text: "true"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.ConfigStatement{
+						Items: []tree.Config{
+							{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "clear_env"},
+								Initialiser: tree.ExpressionStatement{
+									Expression: tree.Literal{Value: value.Bool(true)},
+								},
+							},
+						},
+						Env: []tree.EnvStatement{
+							{
+								Items: []tree.Variable{
+									{
+										Name: token.Token{Type: token.IDENTIFIER, Text: "CI"},
+										Initialiser: tree.ExpressionStatement{
+											Expression: tree.Literal{Value: value.String("true")},
+										},
 									},
 								},
 							},
@@ -677,10 +726,225 @@ func TestStatements(t *testing.T) {
 					tree.ExtendsStatement{
 						Paths: []tree.Expression{
 							tree.Literal{
-								Value: "/some/path",
+								Value: value.String("/some/path"),
 							},
 							tree.Literal{
-								Value: "/another/path",
+								Value: value.String("/another/path"),
+							},
+						},
+					},
+				}
+			},
+		},
+		{
+			name: "import declaration",
+			tokens: func() []token.Token {
+				return []token.Token{
+					{Type: token.IMPORT, Text: "import"},
+					{Type: token.STRING, Text: "\"ci.rny\""},
+					{Type: token.AS, Text: "as"},
+					{Type: token.IDENTIFIER, Text: "ci"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.ImportStatement{
+						Path: tree.Literal{
+							Value: value.String("ci.rny"),
+						},
+						Alias: token.Token{Type: token.IDENTIFIER, Text: "ci"},
+					},
+				}
+			},
+		},
+		{
+			name: "secret variable declaration",
+			tokens: func() []token.Token {
+				secret := token.SECRET
+				return []token.Token{
+					{Type: token.VAR, Text: "var:secret", Modifier: &secret},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "token"},
+					{Type: token.STRING, Text: "abc"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.VariableStatement{
+						Items: []tree.Variable{
+							{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "token"},
+								Initialiser: tree.ExpressionStatement{
+									Expression: tree.Literal{Value: value.String("abc")},
+								},
+							},
+						},
+						Secret: true,
+					},
+				}
+			},
+		},
+		{
+			name: "env declaration",
+			tokens: func() []token.Token {
+				return []token.Token{
+					{Type: token.ENV, Text: "env"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "GOOS"},
+					{Type: token.STRING, Text: "\"linux\""},
+					{Type: token.IDENTIFIER, Text: "COMMIT"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: "git rev-parse HEAD"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.EnvStatement{
+						Items: []tree.Variable{
+							{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "GOOS"},
+								Initialiser: tree.ExpressionStatement{
+									Expression: tree.Literal{Value: value.String("linux")},
+								},
+							},
+							{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "COMMIT"},
+								Initialiser: tree.RunStatement{
+									Body: []tree.Statement{
+										tree.ActionStatement{
+											Body: token.Token{Type: token.SCRIPT, Text: "git rev-parse HEAD"},
+										},
+									},
+								},
+							},
+						},
+					},
+				}
+			},
+		},
+		{
+			name: "test statement",
+			tokens: func() []token.Token {
+				return []token.Token{
+					{Type: token.TEST, Text: "test"},
+					{Type: token.STRING, Text: "\"deploys\""},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.MOCK, Text: "mock"},
+					{Type: token.IDENTIFIER, Text: "docker"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: `echo "docker $@"`},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.IDENTIFIER, Text: "deploy"},
+					{Type: token.EXPECT, Text: "expect"},
+					{Type: token.IDENTIFIER, Text: "output"},
+					{Type: token.IDENTIFIER, Text: "contains"},
+					{Type: token.STRING, Text: "\"docker build\""},
+					{Type: token.EXPECT, Text: "expect"},
+					{Type: token.IDENTIFIER, Text: "exit"},
+					{Type: token.NUMBER, Text: "0"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.TestStatement{
+						Name: token.Token{Type: token.STRING, Text: "deploys"},
+						Body: []tree.Statement{
+							tree.MockStatement{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "docker"},
+								Body: token.Token{Type: token.SCRIPT, Text: `echo "docker $@"`},
+							},
+							tree.RunStatement{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "deploy"},
+								Body: []tree.Statement{},
+							},
+							tree.ExpectStatement{
+								Keyword:  token.Token{Type: token.EXPECT, Text: "expect"},
+								Subject:  token.Token{Type: token.IDENTIFIER, Text: "output"},
+								Operator: token.Token{Type: token.IDENTIFIER, Text: "contains"},
+								Expected: tree.Literal{Value: value.String("docker build")},
+							},
+							tree.ExpectStatement{
+								Keyword:  token.Token{Type: token.EXPECT, Text: "expect"},
+								Subject:  token.Token{Type: token.IDENTIFIER, Text: "exit"},
+								Expected: tree.Literal{Value: value.Number(0)},
+							},
+						},
+					},
+				}
+			},
+		},
+		{
+			name: "expect with an unknown operator",
+			tokens: func() []token.Token {
+				return []token.Token{
+					{Type: token.EXPECT, Text: "expect"},
+					{Type: token.IDENTIFIER, Text: "output"},
+					{Type: token.IDENTIFIER, Text: "is"},
+					{Type: token.STRING, Text: "\"x\""},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			wantErr: "[line 0] parse error at 'is': expect contains, equals or matches\n",
+			want: func() []tree.Statement {
+				return nil
+			},
+		},
+		{
+			name: "silent run statement",
+			tokens: func() []token.Token {
+				silent := token.SILENT
+				return []token.Token{
+					{Type: token.RUN, Text: "run:silent", Modifier: &silent},
+					{Type: token.IDENTIFIER, Text: "build"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.RunStatement{
+						Name:   token.Token{Type: token.IDENTIFIER, Text: "build"},
+						Body:   []tree.Statement{},
+						Silent: true,
+					},
+				}
+			},
+		},
+		{
+			name: "raw script run statement",
+			tokens: func() []token.Token {
+				return []token.Token{
+					{Type: token.TARGET, Text: "target"},
+					{Type: token.IDENTIFIER, Text: "build"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.SCRIPT, Text: "echo }"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.TargetStatement{
+						Name: token.Token{Type: token.IDENTIFIER, Text: "build"},
+						Body: []tree.Statement{
+							tree.RunStatement{
+								Body: []tree.Statement{
+									tree.ActionStatement{
+										Body: token.Token{Type: token.SCRIPT, Text: "echo }"},
+									},
+								},
 							},
 						},
 					},
@@ -712,6 +976,206 @@ func TestStatements(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "typed variable declarations",
+			tokens: func() []token.Token {
+				return []token.Token{
+					{Type: token.VAR, Text: "var"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "threshold"},
+					{Type: token.NUMBER, Text: "80.5"},
+					{Type: token.IDENTIFIER, Text: "debug"},
+					{Type: token.TRUE, Text: "true"},
+					{Type: token.IDENTIFIER, Text: "name"},
+					{Type: token.IDENTIFIER, Text: "$other"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.VariableStatement{
+						Items: []tree.Variable{
+							{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "threshold"},
+								Initialiser: tree.ExpressionStatement{
+									Expression: tree.Literal{Value: value.Number(80.5)},
+								},
+							},
+							{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "debug"},
+								Initialiser: tree.ExpressionStatement{
+									Expression: tree.Literal{Value: value.Bool(true)},
+								},
+							},
+							{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "name"},
+								Initialiser: tree.ExpressionStatement{
+									Expression: tree.Reference{Name: token.Token{Type: token.IDENTIFIER, Text: "other"}},
+								},
+							},
+						},
+					},
+				}
+			},
+		},
+		{
+			name: "list and map variable declarations",
+			tokens: func() []token.Token {
+				return []token.Token{
+					{Type: token.VAR, Text: "var"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "files"},
+					{Type: token.LEFT_BRACKET, Text: "["},
+					{Type: token.STRING, Text: "\"a.go\""},
+					{Type: token.COMMA, Text: ","},
+					{Type: token.STRING, Text: "\"b.go\""},
+					{Type: token.RIGHT_BRACKET, Text: "]"},
+					{Type: token.IDENTIFIER, Text: "server"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.IDENTIFIER, Text: "host"},
+					{Type: token.STRING, Text: "\"localhost\""},
+					{Type: token.COMMA, Text: ","},
+					{Type: token.IDENTIFIER, Text: "port"},
+					{Type: token.NUMBER, Text: "8080"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.VariableStatement{
+						Items: []tree.Variable{
+							{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "files"},
+								Initialiser: tree.ExpressionStatement{
+									Expression: tree.List{
+										Items: []tree.Expression{
+											tree.Literal{Value: value.String("a.go")},
+											tree.Literal{Value: value.String("b.go")},
+										},
+									},
+								},
+							},
+							{
+								Name: token.Token{Type: token.IDENTIFIER, Text: "server"},
+								Initialiser: tree.ExpressionStatement{
+									Expression: tree.Map{
+										Items: []tree.MapItem{
+											{
+												Key:   token.Token{Type: token.IDENTIFIER, Text: "host"},
+												Value: tree.Literal{Value: value.String("localhost")},
+											},
+											{
+												Key:   token.Token{Type: token.IDENTIFIER, Text: "port"},
+												Value: tree.Literal{Value: value.Number(8080)},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				}
+			},
+		},
+		{
+			name: "if else statement",
+			tokens: func() []token.Token {
+				return []token.Token{
+					{Type: token.IF, Text: "if"},
+					{Type: token.IDENTIFIER, Text: "$debug"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: `echo "debug"`},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.ELSE, Text: "else"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.IfStatement{
+						Condition: tree.Reference{Name: token.Token{Type: token.IDENTIFIER, Text: "debug"}},
+						Then: []tree.Statement{
+							tree.RunStatement{
+								Body: []tree.Statement{
+									tree.ActionStatement{
+										Body: token.Token{Type: token.SCRIPT, Text: `echo "debug"`},
+									},
+								},
+							},
+						},
+						Else: []tree.Statement{},
+					},
+				}
+			},
+		},
+		{
+			name: "for loop over glob in parallel",
+			tokens: func() []token.Token {
+				parallel := token.PARALLEL
+				return []token.Token{
+					{Type: token.FOR, Text: "for:parallel", Modifier: &parallel},
+					{Type: token.IDENTIFIER, Text: "file"},
+					{Type: token.IN, Text: "in"},
+					{Type: token.IDENTIFIER, Text: "glob"},
+					{Type: token.LEFT_PAREN, Text: "("},
+					{Type: token.STRING, Text: `"src/*.go"`},
+					{Type: token.RIGHT_PAREN, Text: ")"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.RUN, Text: "run"},
+					{Type: token.LEFT_BRACE, Text: "{"},
+					{Type: token.SCRIPT, Text: `gofmt -l $file`},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.RIGHT_BRACE, Text: "}"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			want: func() []tree.Statement {
+				return []tree.Statement{
+					tree.ForStatement{
+						Name: token.Token{Type: token.IDENTIFIER, Text: "file"},
+						Iterable: tree.Call{
+							Callee: token.Token{Type: token.IDENTIFIER, Text: "glob"},
+							Arguments: []tree.Expression{
+								tree.Literal{Value: value.String("src/*.go")},
+							},
+						},
+						Body: []tree.Statement{
+							tree.RunStatement{
+								Body: []tree.Statement{
+									tree.ActionStatement{
+										Body: token.Token{Type: token.SCRIPT, Text: `gofmt -l $file`},
+									},
+								},
+							},
+						},
+						Parallel: true,
+					},
+				}
+			},
+		},
+		{
+			name: "import declaration: missing alias",
+			tokens: func() []token.Token {
+				return []token.Token{
+					{Type: token.IMPORT, Text: "import"},
+					{Type: token.STRING, Text: "\"ci.rny\""},
+					{Type: token.IDENTIFIER, Text: "ci"},
+					{Type: token.EOF, Text: ""},
+				}
+			},
+			wantErr: "[line 0] parse error at 'ci': expect 'as' after import path\n",
+			want: func() []tree.Statement {
+				return nil
+			},
+		},
 	}
 
 	for _, testcase := range cases {
@@ -763,3 +1227,80 @@ func TestParserErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestParser_ParseSource(t *testing.T) {
+	t.Run("tokens are read as they're needed", func(t *testing.T) {
+		l := lex.New()
+		l.Input = "var { name \"Tim\" }\nrun build"
+		statements, err := parser.New().ParseSource(l)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if len(statements) != 2 {
+			t.Fatalf("want 2 statements, got %d", len(statements))
+		}
+	})
+	t.Run("a lex error stops the parse", func(t *testing.T) {
+		l := lex.New()
+		l.Input = "var { name \"Tim\" }\nrun build\nvar { x ~ }"
+		_, err := parser.New().ParseSource(l)
+		var lexErr *lex.LexError
+		if !errors.As(err, &lexErr) {
+			t.Fatalf("want a lex error, got %v", err)
+		}
+		if err.Error() != "[line 3] lex error at '~': unsupported type, while parsing var\n" {
+			t.Fatalf("unexpected error %q", err.Error())
+		}
+	})
+	t.Run("lex errors say what was being parsed", func(t *testing.T) {
+		l := lex.New()
+		l.Input = "target build {\n    run {\n        echo \"oops\n    }\n}"
+		_, err := parser.New().ParseSource(l)
+		if err == nil || !strings.Contains(err.Error(), "while parsing run in target build\n") {
+			t.Fatalf("unexpected error %v", err)
+		}
+	})
+	t.Run("parsed statements' tokens are let go", func(t *testing.T) {
+		l := lex.New()
+		l.Input = "var { name \"Tim\" }\ntarget build { run { echo $name } }\nrun build"
+		p := parser.New()
+		if _, err := p.ParseSource(l); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		// the last statement and EOF, along with the token before them
+		if len(p.Tokens) != 4 {
+			t.Fatalf("want 4 tokens kept, got %v", lex.TokenNames(p.Tokens))
+		}
+	})
+}
+
+func TestParser_Spans(t *testing.T) {
+	l := lex.New()
+	l.File = "runny.rny"
+	l.Input = "target greet {\n    run { echo $name }\n}\nvar { files [\"a\", \"b\"] }"
+	statements, err := parser.New().ParseSource(l)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	target := statements[0].(tree.TargetStatement)
+	run := target.Body[0].(tree.RunStatement)
+	action := run.Body[0].(tree.ActionStatement)
+	files := statements[1].(tree.VariableStatement).Items[0].Initialiser.(tree.ExpressionStatement).Expression
+	cases := []struct {
+		name  string
+		node  interface{ Where() token.Span }
+		start string
+		end   token.Pos
+	}{
+		{name: "target", node: target, start: "runny.rny:1:1", end: token.Pos{Offset: 39, Line: 3, Column: 2}},
+		{name: "run", node: run, start: "runny.rny:2:5", end: token.Pos{Offset: 37, Line: 2, Column: 23}},
+		{name: "action", node: action, start: "runny.rny:2:11", end: token.Pos{Offset: 35, Line: 2, Column: 21}},
+		{name: "list", node: files, start: "runny.rny:4:13", end: token.Pos{Offset: 62, Line: 4, Column: 23}},
+	}
+	for _, testcase := range cases {
+		span := testcase.node.Where()
+		if span.String() != testcase.start || span.End != testcase.end {
+			t.Errorf("%s: want %s to %+v, got %s to %+v", testcase.name, testcase.start, testcase.end, span, span.End)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package runny
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JUnit records targets as JUnit test cases, so CI systems can show them like tests
+type JUnit struct {
+	Actions bool // record each action as a test case too
+	mutex   sync.Mutex
+	cases   []*junitCase
+	running map[uint64]*junitCase // test cases that have started but not finished, by the ID of their start
+}
+
+type junitCase struct {
+	pkg       string
+	name      string
+	classname string
+	start     time.Time
+	duration  time.Duration
+	stdout    strings.Builder
+	stderr    strings.Builder
+	failure   *junitFailure
+	cancelled bool
+	nested    bool // started while another test case in its package was running
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",cdata"`
+}
+
+// Handle records the events of a run
+func (j *JUnit) Handle(event Event) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.running == nil {
+		j.running = make(map[uint64]*junitCase)
+	}
+	switch event.Type {
+	case TargetStarted:
+		j.start(event, event.Target, event.File)
+	case ActionStarted:
+		if j.Actions {
+			// actions are grouped by their target
+			classname := event.Target
+			if classname == "" {
+				classname = event.File
+			}
+			j.start(event, fmt.Sprintf("%s:%d %s", event.File, event.Line, firstLine(event.Script)), classname)
+		}
+	case Output:
+		// output is recorded by its action and the target it's in
+		for _, id := range []uint64{event.ID, event.TargetID} {
+			if testCase, ok := j.running[id]; ok {
+				output := &testCase.stdout
+				if event.Stream == "stderr" {
+					output = &testCase.stderr
+				}
+				output.WriteString(event.Text + "\n")
+			}
+		}
+	case TargetFinished, ActionFinished:
+		j.finish(event)
+	}
+}
+
+func (j *JUnit) start(event Event, name string, classname string) {
+	if event.Package != "" {
+		classname = event.Package + "/" + classname
+	}
+	testCase := &junitCase{
+		pkg:       event.Package,
+		name:      name,
+		classname: classname,
+		start:     event.Time,
+	}
+	for _, running := range j.running {
+		if running.pkg == event.Package {
+			testCase.nested = true
+		}
+	}
+	j.cases = append(j.cases, testCase)
+	j.running[event.ID] = testCase
+}
+
+func (j *JUnit) finish(event Event) {
+	testCase, ok := j.running[event.ID]
+	if !ok {
+		return
+	}
+	delete(j.running, event.ID)
+	testCase.duration = event.Duration
+	if event.Cancelled {
+		testCase.cancelled = true
+	} else if event.Error != "" {
+		testCase.failure = &junitFailure{
+			Message: event.Error,
+			Type:    fmt.Sprintf("exit code %d", event.ExitCode),
+			Text:    xmlText(testCase.stderr.String()),
+		}
+	}
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	Stdout    *junitOutput  `xml:"system-out,omitempty"`
+	Stderr    *junitOutput  `xml:"system-err,omitempty"`
+}
+
+// output is kept as it was written rather than escaped
+type junitOutput struct {
+	Text string `xml:",cdata"`
+}
+
+func newJUnitOutput(text string) *junitOutput {
+	if text == "" {
+		return nil
+	}
+	return &junitOutput{Text: xmlText(text)}
+}
+
+// colours and other terminal escapes e.g. \x1b[31m
+var terminalEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+// removes terminal escapes and characters XML 1.0 can't contain from output, which
+// CDATA doesn't escape
+func xmlText(text string) string {
+	text = terminalEscape.ReplaceAllString(text, "")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			return r
+		case r < 0x20, r >= 0xD800 && r <= 0xDFFF, r == 0xFFFE, r == 0xFFFF:
+			return -1
+		}
+		return r
+	}, text)
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// WriteXML writes a JUnit report with a test suite per workspace package. Suites
+// outside a workspace are given name.
+func (j *JUnit) WriteXML(out io.Writer, name string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	report := junitTestSuites{
+		Name: "runny",
+	}
+	var total time.Duration
+	suites := make(map[string]int)
+	durations := make(map[string]time.Duration)
+	for _, testCase := range j.cases {
+		suiteName := testCase.pkg
+		if suiteName == "" {
+			suiteName = name
+		}
+		index, ok := suites[suiteName]
+		if !ok {
+			index = len(report.Suites)
+			suites[suiteName] = index
+			report.Suites = append(report.Suites, junitTestSuite{
+				Name:      suiteName,
+				Timestamp: testCase.start.Format(time.RFC3339),
+			})
+		}
+		suite := &report.Suites[index]
+		// a suite takes as long as its outermost test cases
+		if !testCase.nested {
+			durations[suiteName] += testCase.duration
+		}
+
+		encoded := junitTestCase{
+			Name:      testCase.name,
+			Classname: testCase.classname,
+			Time:      seconds(testCase.duration),
+			Failure:   testCase.failure,
+			Stdout:    newJUnitOutput(testCase.stdout.String()),
+			Stderr:    newJUnitOutput(testCase.stderr.String()),
+		}
+		suite.Tests++
+		report.Tests++
+		if testCase.failure != nil {
+			suite.Failures++
+			report.Failures++
+		}
+		if testCase.cancelled {
+			encoded.Skipped = &junitSkipped{Message: "cancelled"}
+			suite.Skipped++
+			report.Skipped++
+		}
+		suite.Cases = append(suite.Cases, encoded)
+	}
+
+	for index := range report.Suites {
+		duration := durations[report.Suites[index].Name]
+		report.Suites[index].Time = seconds(duration)
+		total += duration
+	}
+	report.Time = seconds(total)
+
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(out)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
+
+func seconds(duration time.Duration) string {
+	return fmt.Sprintf("%.3f", duration.Seconds())
+}
@@ -0,0 +1,456 @@
+// Package runny loads and runs runny files from Go programs.
+package runny
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runny/src/check"
+	"runny/src/env"
+	"runny/src/fetch"
+	"runny/src/interpreter"
+	"runny/src/loader"
+	"runny/src/trace"
+	"runny/src/tree"
+	"runny/src/value"
+	"time"
+)
+
+// LockFile is the name of the file remote extends are pinned in
+const LockFile = "runny.lock"
+
+// Project is a parsed runny file, along with the files it extends and imports
+type Project struct {
+	File       string
+	Config     map[string]value.Value // nil where a value is computed when the project runs
+	Vars       []Var
+	Targets    []Target // imported targets are named like ci:build
+	Tests      []Test   // the file's test blocks, run with Project.Test
+	Imports    []string // the names files are imported as e.g. ci
+	Statements []tree.Statement
+	Warnings   []string // problems found while loading that don't stop the project running
+	fsys       fs.FS
+	fetcher    *fetch.Fetcher
+}
+
+type Target struct {
+	Name        string
+	Description []string
+}
+
+type Test struct {
+	Name string
+	File string
+	Line int
+}
+
+// TestResult is how a test block went
+type TestResult = interpreter.TestResult
+
+type Var struct {
+	Name     string
+	Value    value.Value // nil if the variable is computed when run
+	Computed bool
+}
+
+// Mask is shown in place of secret values
+const Mask = interpreter.Mask
+
+// Verbosity is how much is printed besides the output of commands
+type Verbosity = interpreter.Verbosity
+
+const (
+	Normal  = interpreter.Normal
+	Quiet   = interpreter.Quiet
+	Verbose = interpreter.Verbose
+	Silent  = interpreter.Silent
+)
+
+// Event is something that happened during a run, like a command starting or writing a line
+type Event = interpreter.Event
+
+type EventType = interpreter.EventType
+
+const (
+	TargetStarted  = interpreter.TargetStarted
+	TargetFinished = interpreter.TargetFinished
+	ActionStarted  = interpreter.ActionStarted
+	ActionFinished = interpreter.ActionFinished
+	Output         = interpreter.Output
+	Description    = interpreter.Description
+	Failed         = interpreter.Failed
+)
+
+// Handler receives the events of a run
+type Handler = interpreter.Handler
+
+// NewJSONHandler returns a handler writing each event to out as a line of JSON
+func NewJSONHandler(out io.Writer) Handler {
+	return interpreter.NewJSONHandler(out)
+}
+
+// TokenError is returned when a file can't be lexed. Tokens are those of the statement
+// being parsed when it happened.
+type TokenError = loader.TokenError
+
+type LoadOptions struct {
+	// only use remote extends that are already cached
+	Offline bool
+	// allow remote extends over plain http rather than only https
+	AllowHTTP bool
+	// where remote extends are cached, fetch.DefaultCacheDir() if empty
+	CacheDir string
+}
+
+// Load reads a runny file, and the files it extends and imports, from the os filesystem
+func Load(ctx context.Context, path string, opts LoadOptions) (*Project, error) {
+	return load(ctx, nil, path, opts)
+}
+
+// LoadFS reads a runny file from fsys. Extended files are read from fsys too.
+func LoadFS(ctx context.Context, fsys fs.FS, path string, opts LoadOptions) (*Project, error) {
+	return load(ctx, fsys, path, opts)
+}
+
+func load(ctx context.Context, fsys fs.FS, path string, opts LoadOptions) (*Project, error) {
+	fetcher, err := newFetcher(fsys, path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	fileLoader := loader.New(fsys, fetcher)
+	statements, err := fileLoader.Load(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	project := &Project{
+		File:       path,
+		Config:     make(map[string]value.Value),
+		Statements: statements,
+		Warnings:   fileLoader.Warnings,
+		fsys:       fsys,
+		fetcher:    fetcher,
+	}
+	project.describe(statements, "")
+	for _, test := range interpreter.FindTests(statements) {
+		project.Tests = append(project.Tests, Test{
+			Name: test.Name.Text,
+			File: test.Name.File,
+			Line: test.Name.Line,
+		})
+	}
+	return project, nil
+}
+
+// remote extends are pinned in a runny.lock next to the project's file
+func newFetcher(fsys fs.FS, path string, opts LoadOptions) (*fetch.Fetcher, error) {
+	cacheDir := opts.CacheDir
+	if cacheDir == "" {
+		cacheDir = fetch.DefaultCacheDir()
+	}
+	lock := &fetch.Lock{}
+	if fsys == nil {
+		var err error
+		lock, err = fetch.ReadLock(filepath.Join(filepath.Dir(path), LockFile))
+		if err != nil {
+			return nil, err
+		}
+	}
+	fetcher := fetch.New(cacheDir, lock)
+	fetcher.Offline = opts.Offline
+	fetcher.AllowHTTP = opts.AllowHTTP
+	return fetcher, nil
+}
+
+// fills in the project's config, vars and targets from a file's statements. A file's own
+// definitions are preferred to those it extends, and later extends to earlier ones.
+// imported files only contribute targets, prefixed with their import's name.
+func (p *Project) describe(statements []tree.Statement, prefix string) {
+	for _, statement := range statements {
+		switch typed := statement.(type) {
+		case tree.ConfigStatement:
+			if prefix != "" {
+				continue
+			}
+			// config is only read from the file here, values computed by running something wait until the project runs
+			for _, config := range typed.Items {
+				if _, defined := p.Config[config.Name.Text]; !defined {
+					p.Config[config.Name.Text] = literalValue(config.Initialiser)
+				}
+			}
+		case tree.VariableStatement:
+			if prefix != "" {
+				continue
+			}
+			for _, variable := range typed.Items {
+				if p.hasVar(variable.Name.Text) {
+					continue
+				}
+				literal := literalValue(variable.Initialiser)
+				p.Vars = append(p.Vars, Var{
+					Name:     variable.Name.Text,
+					Value:    literal,
+					Computed: literal == nil,
+				})
+			}
+		case tree.TargetStatement:
+			if _, defined := p.Target(prefix + typed.Name.Text); defined {
+				continue
+			}
+			target := Target{
+				Name: prefix + typed.Name.Text,
+			}
+			for _, bodyStatement := range typed.Body {
+				if describe, ok := bodyStatement.(tree.DescribeStatement); ok {
+					for _, line := range describe.Lines {
+						target.Description = append(target.Description, fmt.Sprint(line.Value))
+					}
+				}
+			}
+			p.Targets = append(p.Targets, target)
+		}
+	}
+
+	for _, statement := range statements {
+		if imported, isImport := statement.(tree.ImportStatement); isImport && imported.File != nil {
+			p.Imports = append(p.Imports, prefix+imported.Alias.Text)
+			p.describe(imported.File.Statements, prefix+imported.Alias.Text+":")
+		}
+	}
+
+	for index := len(statements) - 1; index >= 0; index-- {
+		if extends, isExtends := statements[index].(tree.ExtendsStatement); isExtends {
+			for file := len(extends.Files) - 1; file >= 0; file-- {
+				p.describe(extends.Files[file].Statements, prefix)
+			}
+		}
+	}
+}
+
+func (p *Project) hasVar(name string) bool {
+	for _, variable := range p.Vars {
+		if variable.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func literalValue(statement tree.Statement) value.Value {
+	if expression, ok := statement.(tree.ExpressionStatement); ok {
+		return expressionValue(expression.Expression)
+	}
+	return nil
+}
+
+// the value of an expression made only of literals e.g. ["PATH", "HOME"], otherwise nil
+func expressionValue(expression tree.Expression) value.Value {
+	switch typed := expression.(type) {
+	case tree.Literal:
+		if literalValue, ok := typed.Value.(value.Value); ok {
+			return literalValue
+		}
+	case tree.List:
+		list := make(value.List, 0, len(typed.Items))
+		for _, item := range typed.Items {
+			itemValue := expressionValue(item)
+			if itemValue == nil {
+				return nil
+			}
+			list = append(list, itemValue)
+		}
+		return list
+	case tree.Map:
+		mapValue := make(value.Map, len(typed.Items))
+		for _, item := range typed.Items {
+			itemValue := expressionValue(item.Value)
+			if itemValue == nil {
+				return nil
+			}
+			mapValue[item.Key.Text] = itemValue
+		}
+		return mapValue
+	}
+	return nil
+}
+
+// Target returns the target with the given name
+func (p *Project) Target(name string) (Target, bool) {
+	for _, target := range p.Targets {
+		if target.Name == name {
+			return target, true
+		}
+	}
+	return Target{}, false
+}
+
+// Problem is a mistake found by Project.Check
+type Problem = check.Problem
+
+// Check finds mistakes in the file and the files it extends and imports, like running
+// targets that aren't defined, without running anything
+func (p *Project) Check() []Problem {
+	return check.Check(p.Statements)
+}
+
+type Options struct {
+	Stdout io.Writer         // os.Stdout if nil
+	Stderr io.Writer         // os.Stderr if nil
+	Env    []string          // the environment commands start with, os.Environ() if nil
+	Dir    string            // the directory commands run in, the current directory if empty
+	Set    map[string]string // variable overrides, like --set name=value
+	// start commands without waiting for them or printing their output
+	Detach    bool
+	Verbosity Verbosity
+	Colour    bool // highlight printed scripts, for terminals
+	// receives what happens during the run instead of it being printed to Stdout and Stderr
+	Handler Handler
+	// also receive what happens during the run, like a report being written
+	Listeners []Handler
+}
+
+type Result struct {
+	Target   string
+	ExitCode int
+	Duration time.Duration
+	Timings  *Timings // how long each target and action took, unless detached
+}
+
+// Run runs a target, or the file's top-level run statements if target is empty
+func (p *Project) Run(ctx context.Context, target string, opts Options) (*Result, error) {
+	result := &Result{
+		Target:  target,
+		Timings: &Timings{},
+	}
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	start := time.Now()
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	i := p.interpreter(opts)
+	i.Printer.Handler = append(handlers{i.Printer.Handler, result.Timings}, opts.Listeners...)
+	statements := p.Statements
+	if target != "" {
+		var err error
+		statements, err = i.FilterStatementsByTarget(target, statements)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	ctx, span := trace.Start(ctx, "run", runName(target))
+	defer span.Finish()
+	_, err := i.Evaluate(ctx, statements)
+	span.Fail(err)
+	if err != nil {
+		var runtimeErr *interpreter.RuntimeError
+		if errors.As(err, &runtimeErr) {
+			result.ExitCode = runtimeErr.ExitCode
+		}
+		if result.ExitCode == 0 {
+			result.ExitCode = 1
+		}
+		return result, err
+	}
+	return result, nil
+}
+
+func runName(target string) string {
+	if target == "" {
+		return "run"
+	}
+	return "run " + target
+}
+
+// Test runs a test block in a new temporary directory, which its commands run in rather
+// than opts.Dir. Output is only sent to opts.Handler, or printed if opts.Verbosity is Verbose,
+// otherwise it's kept in the result. err is only returned if the test couldn't be run.
+func (p *Project) Test(ctx context.Context, name string, opts Options) (*TestResult, error) {
+	for _, test := range interpreter.FindTests(p.Statements) {
+		if test.Name.Text != name {
+			continue
+		}
+		i := p.interpreter(opts)
+		if opts.Handler == nil && opts.Verbosity != Verbose {
+			i.Printer.Handler = handlers{}
+		}
+		i.Printer.Handler = append(handlers{i.Printer.Handler}, opts.Listeners...)
+		ctx, span := trace.Start(ctx, "test", name)
+		defer span.Finish()
+		result, err := i.RunTest(ctx, test, p.Statements)
+		if err != nil {
+			span.Fail(err)
+		} else if !result.Passed() {
+			span.Fail(errors.New("test failed"))
+		}
+		return result, err
+	}
+	return nil, fmt.Errorf("test '%s' does not exist", name)
+}
+
+type Variable struct {
+	Name   string
+	Value  value.Value
+	Source string // where the value came from e.g. "file" or "cli"
+	Secret bool   // declared with var:secret, Value shouldn't be shown
+}
+
+// Variables evaluates every variable visible to a target (or the top level if target is empty)
+func (p *Project) Variables(ctx context.Context, target string, opts Options) ([]Variable, error) {
+	opts.Detach = true
+	i := p.interpreter(opts)
+	resolved, err := i.ResolveVariables(ctx, target, p.Statements)
+	if err != nil {
+		return nil, err
+	}
+	variables := make([]Variable, 0, len(resolved))
+	for _, variable := range resolved {
+		variables = append(variables, Variable{
+			Name:   variable.Name,
+			Value:  variable.Value,
+			Source: variable.Source.String(),
+			Secret: variable.Secret,
+		})
+	}
+	return variables, nil
+}
+
+func (p *Project) interpreter(opts Options) *interpreter.Interpreter {
+	i := interpreter.New(p.File, !opts.Detach)
+	i.Printer.Out = opts.Stdout
+	i.Printer.Err = opts.Stderr
+	i.Printer.Handler = opts.Handler
+	if opts.Handler == nil {
+		i.Printer.Handler = &interpreter.TextHandler{
+			Out:       opts.Stdout,
+			Err:       opts.Stderr,
+			Verbosity: opts.Verbosity,
+			Colour:    opts.Colour,
+		}
+	}
+	i.Env = opts.Env
+	i.Dir = opts.Dir
+	i.FS = p.fsys
+	i.Fetcher = p.fetcher
+
+	environ := opts.Env
+	if environ == nil {
+		environ = os.Environ()
+	}
+	for name, override := range env.FromEnviron(environ) {
+		i.Environment.Override(name, value.Parse(override), env.SourceEnvironment)
+	}
+	for name, override := range opts.Set {
+		i.Environment.Override(name, value.Parse(override), env.SourceCLI)
+	}
+	return i
+}
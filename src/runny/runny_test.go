@@ -0,0 +1,742 @@
+package runny_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"runny/src/runny"
+	"runny/src/trace"
+	"runny/src/value"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const file = `
+config {
+    shell "sh"
+}
+
+var {
+    name "tim"
+    today {
+        run { date }
+    }
+}
+
+target greet {
+    desc {
+        "says hello"
+    }
+    run { echo "hello $name" }
+}
+
+target fail {
+    run { echo "oh no" >&2; exit 3 }
+}
+
+target home {
+    run { echo "$HOME" }
+}
+
+target forever {
+    run { sleep 30 & wait }
+}
+`
+
+func load(t *testing.T) *runny.Project {
+	project, err := runny.LoadFS(context.Background(), fstest.MapFS{
+		"runny.rny": {Data: []byte(file)},
+	}, "runny.rny", runny.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return project
+}
+
+func TestLoadFS(t *testing.T) {
+	project := load(t)
+
+	assert.Equal(t, map[string]value.Value{"shell": value.String("sh")}, project.Config)
+	assert.Equal(t, []runny.Var{
+		{Name: "name", Value: value.String("tim")},
+		{Name: "today", Computed: true},
+	}, project.Vars)
+	greet, ok := project.Target("greet")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"says hello"}, greet.Description)
+	assert.Len(t, project.Targets, 4)
+}
+
+func TestLoadFS_DoesNotEvaluateConfig(t *testing.T) {
+	// read_file would fail if it was called
+	project, err := runny.LoadFS(context.Background(), fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+config {
+    shell read_file("missing")
+    inherit_env ["PATH", "HOME"]
+}
+`)},
+	}, "runny.rny", runny.LoadOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]value.Value{
+		"shell":       nil,
+		"inherit_env": value.List{value.String("PATH"), value.String("HOME")},
+	}, project.Config)
+}
+
+func TestLoadFS_Errors(t *testing.T) {
+	_, err := runny.LoadFS(context.Background(), fstest.MapFS{
+		"runny.rny": {Data: []byte("var { name ~ }")},
+	}, "runny.rny", runny.LoadOptions{})
+	var tokenErr *runny.TokenError
+	assert.ErrorAs(t, err, &tokenErr)
+
+	_, err = runny.LoadFS(context.Background(), fstest.MapFS{}, "runny.rny", runny.LoadOptions{})
+	assert.Error(t, err)
+}
+
+func TestProject_Run(t *testing.T) {
+	t.Run("output is written to stdout", func(t *testing.T) {
+		var stdout bytes.Buffer
+		result, err := load(t).Run(context.Background(), "greet", runny.Options{
+			Stdout: &stdout,
+			Set:    map[string]string{"name": "jack"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, result.ExitCode)
+		assert.Contains(t, stdout.String(), "> says hello\n")
+		assert.Contains(t, stdout.String(), "hello jack\n")
+	})
+	t.Run("failures return the exit code", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		result, err := load(t).Run(context.Background(), "fail", runny.Options{
+			Stdout: &stdout,
+			Stderr: &stderr,
+		})
+		assert.Error(t, err)
+		assert.Equal(t, 3, result.ExitCode)
+		assert.Equal(t, "oh no\n", stderr.String())
+	})
+	t.Run("commands use the given environment", func(t *testing.T) {
+		var stdout bytes.Buffer
+		_, err := load(t).Run(context.Background(), "home", runny.Options{
+			Stdout: &stdout,
+			Env:    []string{"HOME=/home/runny"},
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, stdout.String(), "/home/runny\n")
+	})
+	t.Run("cancelling stops commands and their children", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := load(t).Run(ctx, "forever", runny.Options{
+			Stdout: &bytes.Buffer{},
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		// the backgrounded sleep holds stdout open until it's killed too
+		assert.Less(t, time.Since(start), 2*time.Second)
+	})
+	t.Run("undefined target", func(t *testing.T) {
+		_, err := load(t).Run(context.Background(), "nope", runny.Options{})
+		assert.EqualError(t, err, "target 'nope' does not exist")
+	})
+}
+
+func TestProject_Variables(t *testing.T) {
+	variables, err := load(t).Variables(context.Background(), "", runny.Options{
+		Env: []string{"RUNNY_VAR_name=jack"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "name", variables[0].Name)
+	assert.Equal(t, value.String("jack"), variables[0].Value)
+	assert.Equal(t, "environment", variables[0].Source)
+}
+
+func TestProject_Imports(t *testing.T) {
+	fsys := fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+import "ci/ci.rny" as ci
+
+extends {
+    "a.rny"
+    "b.rny"
+}
+
+var {
+    version "main"
+}
+
+target all {
+    run ci.build
+    run { echo "main $version $shared" }
+}
+`)},
+		"ci/ci.rny": {Data: []byte(`
+var {
+    version "ci"
+}
+
+target build {
+    run { echo "build $version" }
+}
+
+run { echo "imports don't run anything" }
+`)},
+		"a.rny": {Data: []byte(`
+var { shared "a" }
+target from_a { run { echo "from a $shared" } }
+run { echo "extends don't run anything" }
+`)},
+		"b.rny":      {Data: []byte(`var { shared "b" }`)},
+		"cycle.rny":  {Data: []byte(`extends { "cycle2.rny" }`)},
+		"cycle2.rny": {Data: []byte(`import "cycle.rny" as cycle`)},
+	}
+	project, err := runny.LoadFS(context.Background(), fsys, "runny.rny", runny.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("extended and imported files are loaded", func(t *testing.T) {
+		names := make([]string, 0, len(project.Targets))
+		for _, target := range project.Targets {
+			names = append(names, target.Name)
+		}
+		assert.Equal(t, []string{"all", "ci:build", "from_a"}, names)
+		assert.Equal(t, []string{"ci"}, project.Imports)
+		assert.Equal(t, []string{"variable 'shared' is defined in both a.rny and b.rny, using b.rny"}, project.Warnings)
+	})
+	t.Run("imported targets use their own variables", func(t *testing.T) {
+		var stdout bytes.Buffer
+		_, err := project.Run(context.Background(), "all", runny.Options{
+			Stdout: &stdout,
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, stdout.String(), "build ci\n")
+		assert.Contains(t, stdout.String(), "main main b\n")
+		assert.NotContains(t, stdout.String(), "don't run anything")
+	})
+	t.Run("extended targets can be run directly", func(t *testing.T) {
+		var stdout bytes.Buffer
+		_, err := project.Run(context.Background(), "from_a", runny.Options{
+			Stdout: &stdout,
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, stdout.String(), "from a b\n")
+	})
+	t.Run("imported targets can be run directly", func(t *testing.T) {
+		var stdout bytes.Buffer
+		_, err := project.Run(context.Background(), "ci:build", runny.Options{
+			Stdout: &stdout,
+			Set:    map[string]string{"version": "cli"},
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, stdout.String(), "build cli\n")
+	})
+	t.Run("imported variables", func(t *testing.T) {
+		variables, err := project.Variables(context.Background(), "ci:build", runny.Options{})
+		assert.NoError(t, err)
+		assert.Equal(t, []runny.Variable{{Name: "version", Value: value.String("ci"), Source: "file"}}, variables)
+	})
+	t.Run("circular imports", func(t *testing.T) {
+		_, err := runny.LoadFS(context.Background(), fsys, "cycle.rny", runny.LoadOptions{})
+		assert.EqualError(t, err, "circular import: cycle.rny -> cycle2.rny -> cycle.rny")
+	})
+}
+
+func TestProject_Env(t *testing.T) {
+	fsys := fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+var { version "1.2" }
+
+env {
+    APP_VERSION $version
+    GOOS "linux"
+}
+
+target build {
+    env {
+        COMMIT {
+            run { echo "abc123" }
+        }
+    }
+    run { echo "$APP_VERSION $GOOS $COMMIT ${HOME:-unset}" }
+}
+
+target cross {
+    run build {
+        env { GOOS "darwin" }
+    }
+}
+`)},
+		"clear.rny": {Data: []byte(`
+config {
+    clear_env true
+    inherit_env ["RUNNY_KEEP"]
+}
+
+env { MINE "yes" }
+
+run { echo "${RUNNY_KEEP:-unset} ${RUNNY_DROP:-unset} $MINE" }
+`)},
+	}
+	environ := []string{"HOME=/home/runny", "RUNNY_KEEP=kept", "RUNNY_DROP=dropped"}
+
+	t.Run("env blocks are exported to commands", func(t *testing.T) {
+		project, err := runny.LoadFS(context.Background(), fsys, "runny.rny", runny.LoadOptions{})
+		assert.NoError(t, err)
+		var stdout bytes.Buffer
+		_, err = project.Run(context.Background(), "build", runny.Options{
+			Stdout: &stdout,
+			Env:    environ,
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, stdout.String(), "1.2 linux abc123 /home/runny\n")
+	})
+	t.Run("env blocks in a run override the target's", func(t *testing.T) {
+		project, err := runny.LoadFS(context.Background(), fsys, "runny.rny", runny.LoadOptions{})
+		assert.NoError(t, err)
+		var stdout bytes.Buffer
+		_, err = project.Run(context.Background(), "cross", runny.Options{
+			Stdout: &stdout,
+			Env:    environ,
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, stdout.String(), "1.2 darwin abc123 /home/runny\n")
+	})
+	t.Run("clear_env only inherits listed variables", func(t *testing.T) {
+		project, err := runny.LoadFS(context.Background(), fsys, "clear.rny", runny.LoadOptions{})
+		assert.NoError(t, err)
+		var stdout bytes.Buffer
+		_, err = project.Run(context.Background(), "", runny.Options{
+			Stdout: &stdout,
+			Env:    environ,
+		})
+		assert.NoError(t, err)
+		assert.Contains(t, stdout.String(), "kept unset yes\n")
+	})
+}
+
+func TestProject_Secrets(t *testing.T) {
+	project, err := runny.LoadFS(context.Background(), fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+var:secret {
+    token env("API_TOKEN")
+}
+var { name "tim" }
+
+target deploy {
+    run { echo "deploying $name with $token"; echo "using $token" >&2 }
+}
+
+target fail {
+    for item in $token { run { echo $item } }
+}
+`)},
+	}, "runny.rny", runny.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := func(stdout, stderr *bytes.Buffer) runny.Options {
+		return runny.Options{
+			Stdout: stdout,
+			Stderr: stderr,
+			Env:    []string{"API_TOKEN=hunter2"},
+		}
+	}
+
+	t.Run("secrets are masked in output", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		_, err := project.Run(context.Background(), "deploy", opts(&stdout, &stderr))
+		assert.NoError(t, err)
+		assert.Contains(t, stdout.String(), "deploying tim with ***\n")
+		assert.Equal(t, "using ***\n", stderr.String())
+	})
+	t.Run("secrets are masked in errors", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		_, err := project.Run(context.Background(), "fail", opts(&stdout, &stderr))
+		assert.EqualError(t, err, "runtime error: cannot loop over ***, expected a list\n")
+	})
+	t.Run("secret variables are marked", func(t *testing.T) {
+		variables, err := project.Variables(context.Background(), "", runny.Options{
+			Env: []string{"API_TOKEN=hunter2"},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []runny.Variable{
+			{Name: "name", Value: value.String("tim"), Source: "file"},
+			{Name: "token", Value: value.String("hunter2"), Source: "file", Secret: true},
+		}, variables)
+	})
+}
+
+func TestProject_Verbosity(t *testing.T) {
+	project, err := runny.LoadFS(context.Background(), fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+var { name "tim" }
+
+target hello {
+    desc { "says hello" }
+    run:silent { echo "setting up" }
+    run { echo "hello $name" }
+}
+`)},
+	}, "runny.rny", runny.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(opts runny.Options) string {
+		var stdout bytes.Buffer
+		opts.Stdout = &stdout
+		_, err := project.Run(context.Background(), "hello", opts)
+		assert.NoError(t, err)
+		return stdout.String()
+	}
+
+	t.Run("scripts are printed before they run", func(t *testing.T) {
+		assert.Equal(t, "> says hello\nsetting up\necho \"hello $name\"\nhello tim\n", run(runny.Options{}))
+	})
+	t.Run("colour highlights scripts", func(t *testing.T) {
+		assert.Contains(t, run(runny.Options{Colour: true}), "\033[32mecho \"hello $name\"\033[0m\n")
+	})
+	t.Run("quiet only prints command output", func(t *testing.T) {
+		assert.Equal(t, "setting up\nhello tim\n", run(runny.Options{Verbosity: runny.Quiet}))
+	})
+	t.Run("verbose prints the environment and timings", func(t *testing.T) {
+		output := run(runny.Options{Verbosity: runny.Verbose})
+		assert.Contains(t, output, "echo \"hello $name\"\n  name=tim\nhello tim\ntook ")
+	})
+	t.Run("silent prints nothing", func(t *testing.T) {
+		assert.Equal(t, "", run(runny.Options{Verbosity: runny.Silent}))
+	})
+}
+
+type recorder struct {
+	mutex  sync.Mutex
+	events []runny.Event
+}
+
+func (r *recorder) Handle(event runny.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+func TestProject_Events(t *testing.T) {
+	t.Run("a run is a stream of events", func(t *testing.T) {
+		events := &recorder{}
+		_, err := load(t).Run(context.Background(), "greet", runny.Options{
+			Handler: events,
+		})
+		assert.NoError(t, err)
+		types := make([]runny.EventType, 0, len(events.events))
+		for _, event := range events.events {
+			types = append(types, event.Type)
+			assert.Equal(t, "greet", event.Target)
+		}
+		assert.Equal(t, []runny.EventType{
+			runny.TargetStarted,
+			runny.Description,
+			runny.ActionStarted,
+			runny.Output,
+			runny.ActionFinished,
+			runny.TargetFinished,
+		}, types)
+		action := events.events[2]
+		assert.Equal(t, `echo "hello $name"`, action.Script)
+		assert.Equal(t, 17, action.Line)
+		assert.Equal(t, "hello tim", events.events[3].Text)
+	})
+	t.Run("failures are events too", func(t *testing.T) {
+		events := &recorder{}
+		_, err := load(t).Run(context.Background(), "fail", runny.Options{
+			Handler: events,
+		})
+		assert.Error(t, err)
+		assert.Len(t, events.events, 5)
+		stderr := events.events[2]
+		assert.Equal(t, "stderr", stderr.Stream)
+		assert.Equal(t, "oh no", stderr.Text)
+		finished := events.events[4]
+		assert.Equal(t, runny.TargetFinished, finished.Type)
+		assert.Equal(t, 3, finished.ExitCode)
+	})
+	t.Run("json events are one per line", func(t *testing.T) {
+		var stdout bytes.Buffer
+		_, err := load(t).Run(context.Background(), "greet", runny.Options{
+			Handler: runny.NewJSONHandler(&stdout),
+		})
+		assert.NoError(t, err)
+		lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+		assert.Len(t, lines, 6)
+		var output map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[3]), &output))
+		assert.Equal(t, "output", output["type"])
+		assert.Equal(t, "stdout", output["stream"])
+		assert.Equal(t, "hello tim", output["text"])
+	})
+}
+
+func TestProject_Timings(t *testing.T) {
+	project, err := runny.LoadFS(context.Background(), fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+target slow {
+    run { sleep 0.1 }
+}
+
+target all {
+    run slow
+    run { exit 2 }
+}
+`)},
+	}, "runny.rny", runny.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _ := project.Run(context.Background(), "all", runny.Options{
+		Stdout: &bytes.Buffer{},
+	})
+	timings := result.Timings
+
+	t.Run("targets and actions are timed", func(t *testing.T) {
+		assert.Len(t, timings.Targets, 2)
+		assert.Equal(t, "slow", timings.Targets[0].Target)
+		assert.Equal(t, runny.StatusPassed, timings.Targets[0].Status)
+		assert.GreaterOrEqual(t, timings.Targets[0].Duration, 100*time.Millisecond)
+		assert.Equal(t, "all", timings.Targets[1].Target)
+		assert.Equal(t, runny.StatusFailed, timings.Targets[1].Status)
+		assert.Equal(t, 2, timings.Targets[1].ExitCode)
+		assert.Equal(t, "sleep 0.1", timings.Slowest(1)[0].Script)
+	})
+	t.Run("summary", func(t *testing.T) {
+		var summary bytes.Buffer
+		assert.NoError(t, timings.WriteSummary(&summary, 5))
+		assert.Contains(t, summary.String(), "2 targets: 1 passed, 1 failed, 0 cancelled\n")
+	})
+	t.Run("json", func(t *testing.T) {
+		var encoded bytes.Buffer
+		assert.NoError(t, timings.WriteJSON(&encoded))
+		var decoded struct {
+			Targets []map[string]interface{}
+		}
+		assert.NoError(t, json.Unmarshal(encoded.Bytes(), &decoded))
+		assert.Equal(t, "failed", decoded.Targets[1]["status"])
+		assert.Contains(t, decoded.Targets[0], "duration_ms")
+	})
+}
+
+func TestJUnit(t *testing.T) {
+	junit := &runny.JUnit{Actions: true}
+	var stdout bytes.Buffer
+	_, err := load(t).Run(context.Background(), "fail", runny.Options{
+		Stdout:    &stdout,
+		Stderr:    &bytes.Buffer{},
+		Listeners: []runny.Handler{junit},
+	})
+	assert.Error(t, err)
+	// listeners don't stop output being printed
+	assert.Contains(t, stdout.String(), "exit 3")
+
+	var report bytes.Buffer
+	assert.NoError(t, junit.WriteXML(&report, "runny.rny"))
+	assert.Contains(t, report.String(), `<testsuites name="runny" tests="2" failures="2" skipped="0"`)
+	assert.Contains(t, report.String(), `<testcase name="fail" classname="runny.rny"`)
+	assert.Contains(t, report.String(), `<failure message="runtime error: runny.rny:21: exit status 3" type="exit code 3"><![CDATA[oh no`)
+	assert.Contains(t, report.String(), `<testcase name="runny.rny:21 echo &#34;oh no&#34; &gt;&amp;2; exit 3" classname="fail"`)
+}
+
+func TestJUnit_Parallel(t *testing.T) {
+	project, err := runny.LoadFS(context.Background(), fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+target b {
+    run { sleep 0.1; echo "b $n" }
+}
+target a {
+    for:parallel n in ["1", "2"] {
+        run b
+    }
+}
+`)},
+	}, "runny.rny", runny.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	junit := &runny.JUnit{}
+	_, err = project.Run(context.Background(), "a", runny.Options{
+		Stdout:    &bytes.Buffer{},
+		Listeners: []runny.Handler{junit},
+	})
+	assert.NoError(t, err)
+
+	var report bytes.Buffer
+	assert.NoError(t, junit.WriteXML(&report, "runny.rny"))
+	var decoded struct {
+		Suites []struct {
+			Cases []struct {
+				Name   string `xml:"name,attr"`
+				Time   string `xml:"time,attr"`
+				Stdout string `xml:"system-out"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}
+	assert.NoError(t, xml.Unmarshal(report.Bytes(), &decoded))
+	// each start of b is its own test case with its own output
+	var outputs []string
+	for _, testCase := range decoded.Suites[0].Cases {
+		if testCase.Name != "b" {
+			continue
+		}
+		assert.NotEqual(t, "0.000", testCase.Time)
+		outputs = append(outputs, testCase.Stdout)
+	}
+	assert.ElementsMatch(t, []string{"b 1\n", "b 2\n"}, outputs)
+}
+
+func TestJUnit_TerminalEscapes(t *testing.T) {
+	junit := &runny.JUnit{}
+	junit.Handle(runny.Event{Type: runny.TargetStarted, ID: 1, TargetID: 1, Target: "build"})
+	junit.Handle(runny.Event{Type: runny.Output, ID: 2, TargetID: 1, Stream: "stdout", Text: "\x1b[32mok\x1b[0m \x07done"})
+	junit.Handle(runny.Event{Type: runny.Output, ID: 2, TargetID: 1, Stream: "stderr", Text: "\x1b[31mfailed\x1b[0m"})
+	junit.Handle(runny.Event{Type: runny.TargetFinished, ID: 1, TargetID: 1, Target: "build", Error: "exit status 1", ExitCode: 1})
+
+	var report bytes.Buffer
+	assert.NoError(t, junit.WriteXML(&report, "runny.rny"))
+	var decoded struct {
+		Suites []struct {
+			Cases []struct {
+				Stdout  string `xml:"system-out"`
+				Failure string `xml:"failure"`
+			} `xml:"testcase"`
+		} `xml:"testsuite"`
+	}
+	assert.NoError(t, xml.Unmarshal(report.Bytes(), &decoded))
+	assert.Equal(t, "ok done\n", decoded.Suites[0].Cases[0].Stdout)
+	assert.Equal(t, "failed\n", decoded.Suites[0].Cases[0].Failure)
+}
+
+func TestProject_Trace(t *testing.T) {
+	tracer := trace.New()
+	ctx := trace.WithTracer(context.Background(), tracer)
+	project, err := runny.LoadFS(ctx, fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+extends {
+    "base.rny"
+}
+
+target build {
+    run { echo $sha }
+}
+`)},
+		"base.rny": {Data: []byte(`
+var {
+    sha {
+        run { echo abc }
+    }
+}
+`)},
+	}, "runny.rny", runny.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = project.Run(ctx, "build", runny.Options{
+		Stdout: &bytes.Buffer{},
+	})
+	assert.NoError(t, err)
+
+	names := make([]string, 0)
+	for _, span := range tracer.Spans() {
+		names = append(names, span.Category+" "+span.Name)
+	}
+	assert.Equal(t, []string{
+		"load runny.rny",
+		"load read",
+		"load lex and parse",
+		"extends extends base.rny",
+		"load base.rny",
+		"load read",
+		"load lex and parse",
+		"run run build",
+		"target build",
+		"variable sha",
+		"action runny.rny:7",
+	}, names)
+}
+
+func TestProject_Test(t *testing.T) {
+	project, err := runny.LoadFS(context.Background(), fstest.MapFS{
+		"runny.rny": {Data: []byte(`
+var {
+    tag "v1"
+}
+
+target deploy {
+    run { docker build -t app:$tag . && pwd }
+}
+
+target fail {
+    run { echo "oh no" >&2; exit 3 }
+}
+
+test "deploy builds image" {
+    mock docker {
+        echo "docker $@"
+    }
+    run deploy
+    expect output contains "docker build -t app:v1 ."
+    expect stdout matches "runny-test-[0-9]+/work"
+    expect exit 0
+}
+
+test "fail exits 3" {
+    run fail
+    expect exit 3
+    expect stderr equals "oh no"
+}
+
+test "unmet expectations" {
+    run fail
+    expect output contains "oh yes"
+}
+`)},
+	}, "runny.rny", runny.LoadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []runny.Test{
+		{Name: "deploy builds image", File: "runny.rny", Line: 14},
+		{Name: "fail exits 3", File: "runny.rny", Line: 24},
+		{Name: "unmet expectations", File: "runny.rny", Line: 30},
+	}, project.Tests)
+
+	t.Run("commands are mocked in a temporary directory", func(t *testing.T) {
+		var stdout bytes.Buffer
+		result, err := project.Test(context.Background(), "deploy builds image", runny.Options{Stdout: &stdout})
+		assert.NoError(t, err)
+		assert.True(t, result.Passed(), result.Failures, result.Err)
+		assert.Equal(t, "docker build -t app:v1 .", result.Output[0])
+		// output is kept in the result rather than printed
+		assert.Empty(t, stdout.String())
+	})
+	t.Run("an expected exit code passes", func(t *testing.T) {
+		result, err := project.Test(context.Background(), "fail exits 3", runny.Options{})
+		assert.NoError(t, err)
+		assert.True(t, result.Passed(), result.Failures, result.Err)
+		assert.Equal(t, 3, result.ExitCode)
+	})
+	t.Run("failures", func(t *testing.T) {
+		result, err := project.Test(context.Background(), "unmet expectations", runny.Options{})
+		assert.NoError(t, err)
+		assert.False(t, result.Passed())
+		assert.Equal(t, []string{`runny.rny:32: expected output to contain "oh yes"`}, result.Failures)
+		assert.Error(t, result.Err)
+	})
+	t.Run("unknown test", func(t *testing.T) {
+		_, err := project.Test(context.Background(), "missing", runny.Options{})
+		assert.EqualError(t, err, "test 'missing' does not exist")
+	})
+}
@@ -0,0 +1,162 @@
+package runny
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Timings are how long each target and action of a run took
+type Timings struct {
+	Targets []Timing `json:"targets"`
+	Actions []Timing `json:"actions"`
+	mutex   sync.Mutex
+}
+
+type Timing struct {
+	Package  string        `json:"package,omitempty"`
+	Target   string        `json:"target,omitempty"`
+	Script   string        `json:"script,omitempty"` // for actions
+	File     string        `json:"file,omitempty"`
+	Line     int           `json:"line,omitempty"`
+	Status   Status        `json:"status"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"-"`
+}
+
+type Status string
+
+const (
+	StatusPassed    Status = "passed"
+	StatusFailed    Status = "failed"
+	StatusCancelled Status = "cancelled"
+)
+
+func (t Timing) MarshalJSON() ([]byte, error) {
+	type timing Timing
+	return json.Marshal(struct {
+		timing
+		DurationMs int64 `json:"duration_ms"`
+	}{timing(t), t.Duration.Milliseconds()})
+}
+
+// Handle records finished targets and actions
+func (t *Timings) Handle(event Event) {
+	if event.Type != TargetFinished && event.Type != ActionFinished {
+		return
+	}
+	timing := Timing{
+		Package:  event.Package,
+		Target:   event.Target,
+		File:     event.File,
+		Line:     event.Line,
+		Status:   StatusPassed,
+		ExitCode: event.ExitCode,
+		Duration: event.Duration,
+	}
+	if event.Cancelled {
+		timing.Status = StatusCancelled
+	} else if event.Error != "" {
+		timing.Status = StatusFailed
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if event.Type == TargetFinished {
+		t.Targets = append(t.Targets, timing)
+	} else {
+		timing.Script = event.Script
+		t.Actions = append(t.Actions, timing)
+	}
+}
+
+// Add appends another run's timings e.g. those of each package in a workspace
+func (t *Timings) Add(other *Timings, pkg string) {
+	if other == nil {
+		return
+	}
+	for _, timing := range other.Targets {
+		timing.Package = pkg
+		t.Targets = append(t.Targets, timing)
+	}
+	for _, timing := range other.Actions {
+		timing.Package = pkg
+		t.Actions = append(t.Actions, timing)
+	}
+}
+
+// Slowest returns the n actions that took longest, slowest first
+func (t *Timings) Slowest(n int) []Timing {
+	actions := append([]Timing{}, t.Actions...)
+	sort.SliceStable(actions, func(a, b int) bool {
+		return actions[a].Duration > actions[b].Duration
+	})
+	if len(actions) > n {
+		actions = actions[:n]
+	}
+	return actions
+}
+
+// WriteSummary writes a table of each target's duration and status, followed by the slowest actions
+func (t *Timings) WriteSummary(out io.Writer, slowest int) error {
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	counts := make(map[Status]int)
+	fmt.Fprintln(writer, "target\tstatus\tduration")
+	for _, timing := range t.Targets {
+		counts[timing.Status]++
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", timing.name(), timing.Status, timing.Duration.Round(time.Millisecond))
+	}
+	if actions := t.Slowest(slowest); len(actions) > 0 {
+		fmt.Fprintln(writer, "\nslowest step\tduration\tscript")
+		for _, timing := range actions {
+			fmt.Fprintf(writer, "%s\t%s\t%s\n", timing.location(), timing.Duration.Round(time.Millisecond), firstLine(timing.Script))
+		}
+	}
+	fmt.Fprintf(writer, "\n%d targets: %d passed, %d failed, %d cancelled\n", len(t.Targets), counts[StatusPassed], counts[StatusFailed], counts[StatusCancelled])
+	return writer.Flush()
+}
+
+// WriteJSON writes the timings as a JSON document
+func (t *Timings) WriteJSON(out io.Writer) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(t)
+}
+
+func (t Timing) name() string {
+	if t.Package != "" {
+		return t.Package + ":" + t.Target
+	}
+	return t.Target
+}
+
+func (t Timing) location() string {
+	location := fmt.Sprintf("%s:%d", t.File, t.Line)
+	if t.Package != "" {
+		location = t.Package + "/" + location
+	}
+	return location
+}
+
+// long scripts are cut to their first line
+func firstLine(script string) string {
+	script = strings.TrimSpace(script)
+	if line, _, multiline := strings.Cut(script, "\n"); multiline {
+		return line + " ..."
+	}
+	return script
+}
+
+// handlers sends events to several handlers
+type handlers []Handler
+
+func (h handlers) Handle(event Event) {
+	for _, handler := range h {
+		handler.Handle(event)
+	}
+}
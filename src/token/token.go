@@ -1,15 +1,23 @@
 package token
 
+import "fmt"
+
 type TokenType int
 
 const (
 	LEFT_BRACE TokenType = iota
 	RIGHT_BRACE
+	LEFT_BRACKET
+	RIGHT_BRACKET
+	LEFT_PAREN
+	RIGHT_PAREN
 	COMMA
 
 	IDENTIFIER
 	STRING
 	NUMBER
+	TRUE
+	FALSE
 	COMMENT
 	SCRIPT
 
@@ -19,6 +27,16 @@ const (
 	CONFIG
 	EXTENDS
 	DESCRIBE
+	IF
+	ELSE
+	FOR
+	IN
+	IMPORT
+	AS
+	ENV
+	TEST
+	MOCK
+	EXPECT
 
 	NEWLINE
 	NONE
@@ -26,13 +44,19 @@ const (
 )
 
 var TokenTypeNames = map[TokenType]string{
-	LEFT_BRACE:  "LEFT_BRACE",
-	RIGHT_BRACE: "RIGHT_BRACE",
-	COMMA:       "COMMA",
+	LEFT_BRACE:    "LEFT_BRACE",
+	RIGHT_BRACE:   "RIGHT_BRACE",
+	LEFT_BRACKET:  "LEFT_BRACKET",
+	RIGHT_BRACKET: "RIGHT_BRACKET",
+	LEFT_PAREN:    "LEFT_PAREN",
+	RIGHT_PAREN:   "RIGHT_PAREN",
+	COMMA:         "COMMA",
 
 	IDENTIFIER: "IDENTIFIER",
 	STRING:     "STRING",
 	NUMBER:     "NUMBER",
+	TRUE:       "TRUE",
+	FALSE:      "FALSE",
 	COMMENT:    "COMMENT",
 	SCRIPT:     "SCRIPT",
 
@@ -42,6 +66,16 @@ var TokenTypeNames = map[TokenType]string{
 	CONFIG:   "CONFIG",
 	EXTENDS:  "EXTENDS",
 	DESCRIBE: "DESCRIBE",
+	IF:       "IF",
+	ELSE:     "ELSE",
+	FOR:      "FOR",
+	IN:       "IN",
+	IMPORT:   "IMPORT",
+	AS:       "AS",
+	ENV:      "ENV",
+	TEST:     "TEST",
+	MOCK:     "MOCK",
+	EXPECT:   "EXPECT",
 
 	NEWLINE: "NEWLINE",
 	NONE:    "NONE",
@@ -55,6 +89,18 @@ var Keywords = map[string]TokenType{
 	"config":  CONFIG,
 	"extends": EXTENDS,
 	"desc":    DESCRIBE,
+	"if":      IF,
+	"else":    ELSE,
+	"for":     FOR,
+	"in":      IN,
+	"import":  IMPORT,
+	"as":      AS,
+	"env":     ENV,
+	"test":    TEST,
+	"mock":    MOCK,
+	"expect":  EXPECT,
+	"true":    TRUE,
+	"false":   FALSE,
 }
 
 type TokenModifier int
@@ -62,23 +108,62 @@ type TokenModifier int
 const (
 	BEFORE TokenModifier = iota
 	AFTER
+	PARALLEL
+	SECRET
+	SILENT
 )
 
 var TokenModifierNames = map[TokenModifier]string{
-	BEFORE: "BEFORE",
-	AFTER:  "AFTER",
+	BEFORE:   "BEFORE",
+	AFTER:    "AFTER",
+	PARALLEL: "PARALLEL",
+	SECRET:   "SECRET",
+	SILENT:   "SILENT",
 }
 
 var Modifiers = map[string]TokenModifier{
-	"before": BEFORE,
-	"after":  AFTER,
+	"before":   BEFORE,
+	"after":    AFTER,
+	"parallel": PARALLEL,
+	"secret":   SECRET,
+	"silent":   SILENT,
 }
 
 type Token struct {
 	Type     TokenType
 	Text     string
+	File     string // the file the token was read from, if known
 	Position int
 	Line     int
 	Depth    int
 	Modifier *TokenModifier
+	Span     Span // exactly where the token is, quotes and all
+}
+
+// Pos is a place in a file. Offsets start at 0, and lines and columns at 1.
+// Columns count bytes rather than characters, like offsets do.
+type Pos struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+// Span is the part of a file something was read from, from Start up to but not including End
+type Span struct {
+	File  string
+	Start Pos
+	End   Pos
+}
+
+// String describes where a span starts e.g. "ci.rny:3:5"
+func (s Span) String() string {
+	return fmt.Sprintf("%s:%d", Location(s.File, s.Start.Line), s.Start.Column)
+}
+
+// Location describes where a token is for error messages e.g. "line 3" or "ci.rny:3"
+func Location(file string, line int) string {
+	if file == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", file, line)
 }
@@ -0,0 +1,181 @@
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+type chromeTrace struct {
+	TraceEvents     []chromeEvent `json:"traceEvents"`
+	DisplayTimeUnit string        `json:"displayTimeUnit"`
+}
+
+// a complete ("X") event of the Chrome trace event format
+type chromeEvent struct {
+	Name     string            `json:"name"`
+	Category string            `json:"cat"`
+	Phase    string            `json:"ph"`
+	Time     int64             `json:"ts"`  // microseconds since the first span started
+	Duration int64             `json:"dur"` // microseconds
+	Process  int               `json:"pid"`
+	Thread   int               `json:"tid"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+// WriteChrome writes the spans in Chrome's trace event format, which Perfetto and chrome://tracing open
+func (t *Tracer) WriteChrome(out io.Writer) error {
+	spans := t.Spans()
+	trace := chromeTrace{
+		TraceEvents:     []chromeEvent{},
+		DisplayTimeUnit: "ms",
+	}
+	var origin time.Time
+	if len(spans) > 0 {
+		origin = spans[0].Start
+	}
+	t.mutex.Lock()
+	for _, span := range spans {
+		args := make(map[string]string, len(span.Attributes)+1)
+		for key, value := range span.Attributes {
+			args[key] = value
+		}
+		if span.Error != "" {
+			args["error"] = span.Error
+		}
+		trace.TraceEvents = append(trace.TraceEvents, chromeEvent{
+			Name:     span.Name,
+			Category: span.Category,
+			Phase:    "X",
+			Time:     span.Start.Sub(origin).Microseconds(),
+			Duration: span.duration().Microseconds(),
+			Process:  1,
+			Thread:   span.lane,
+			Args:     args,
+		})
+	}
+	t.mutex.Unlock()
+	return encode(out, trace)
+}
+
+type otlpTrace struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 1 is ok and 2 is an error
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpKindInternal = 1
+	otlpStatusOk     = 1
+	otlpStatusError  = 2
+)
+
+// WriteOTLP writes the spans in the JSON encoding of the OpenTelemetry protocol,
+// which collectors and tracing backends can import
+func (t *Tracer) WriteOTLP(out io.Writer) error {
+	spans := t.Spans()
+	scope := otlpScopeSpans{
+		Scope: otlpScope{Name: "runny"},
+		Spans: []otlpSpan{},
+	}
+	traceID := t.id()
+	t.mutex.Lock()
+	for _, span := range spans {
+		encoded := otlpSpan{
+			TraceID:           traceID,
+			SpanID:            spanID(span),
+			Name:              span.Name,
+			Kind:              otlpKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.Start.Add(span.duration()).UnixNano(), 10),
+			Attributes:        []otlpAttribute{stringAttribute("runny.category", span.Category)},
+			Status:            otlpStatus{Code: otlpStatusOk},
+		}
+		if span.parent != nil {
+			encoded.ParentSpanID = spanID(span.parent)
+		}
+		for _, key := range sortedKeys(span.Attributes) {
+			encoded.Attributes = append(encoded.Attributes, stringAttribute(key, span.Attributes[key]))
+		}
+		if span.Error != "" {
+			encoded.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+		scope.Spans = append(scope.Spans, encoded)
+	}
+	t.mutex.Unlock()
+	return encode(out, otlpTrace{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{stringAttribute("service.name", "runny")},
+			},
+			ScopeSpans: []otlpScopeSpans{scope},
+		}},
+	})
+}
+
+func stringAttribute(key string, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: value}}
+}
+
+// span ids are 8 bytes of hex
+func spanID(span *Span) string {
+	return fmt.Sprintf("%016x", span.id)
+}
+
+// spans that never finished, like those of a run that panicked, end when they're written
+func (s *Span) duration() time.Duration {
+	if s.End.IsZero() {
+		return time.Since(s.Start)
+	}
+	return s.End.Sub(s.Start)
+}
+
+func encode(out io.Writer, document any) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(document)
+}
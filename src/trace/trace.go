@@ -0,0 +1,146 @@
+// Package trace records how long the parts of a run take, from loading files
+// to running commands, and writes them as Chrome trace events or OTLP JSON.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tracer collects spans. It's carried in a context so every part of runny can add to it.
+type Tracer struct {
+	mutex   sync.Mutex
+	traceID [16]byte
+	spans   []*Span
+	lanes   int // spans that overlap their siblings are drawn in their own lane
+}
+
+func New() *Tracer {
+	tracer := &Tracer{}
+	rand.Read(tracer.traceID[:])
+	return tracer
+}
+
+// Span is a timed part of a run
+type Span struct {
+	Category   string // e.g. "load", "target" or "action"
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+	id         uint64
+	parent     *Span
+	lane       int
+	open       int // children that haven't ended
+	tracer     *Tracer
+}
+
+type contextKey int
+
+const (
+	tracerKey contextKey = iota
+	spanKey
+)
+
+// WithTracer returns a context that spans are recorded in
+func WithTracer(ctx context.Context, tracer *Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey, tracer)
+}
+
+// Start begins a span inside the context's current span. The span isn't recorded, and
+// is nil, if the context has no tracer. attributes are pairs of keys and values.
+func Start(ctx context.Context, category string, name string, attributes ...string) (context.Context, *Span) {
+	tracer, _ := ctx.Value(tracerKey).(*Tracer)
+	if tracer == nil {
+		return ctx, nil
+	}
+	parent, _ := ctx.Value(spanKey).(*Span)
+	span := tracer.start(parent, category, name)
+	for index := 0; index+1 < len(attributes); index += 2 {
+		span.Attributes[attributes[index]] = attributes[index+1]
+	}
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+func (t *Tracer) start(parent *Span, category string, name string) *Span {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	span := &Span{
+		Category:   category,
+		Name:       name,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+		id:         uint64(len(t.spans) + 1),
+		parent:     parent,
+		tracer:     t,
+	}
+	if parent != nil {
+		span.lane = parent.lane
+		if parent.open > 0 {
+			// running at the same time as a sibling e.g. in a parallel loop
+			t.lanes++
+			span.lane = t.lanes
+		}
+		parent.open++
+	}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+// SetAttribute records something about the span, like the file a target is in
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.Attributes[key] = value
+}
+
+// Fail marks the span as failed
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the span
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.End = time.Now()
+	if s.parent != nil {
+		s.parent.open--
+	}
+}
+
+// Spans returns every span recorded so far, in the order they started
+func (t *Tracer) Spans() []*Span {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]*Span{}, t.spans...)
+}
+
+func (t *Tracer) id() string {
+	return hex.EncodeToString(t.traceID[:])
+}
+
+func sortedKeys(attributes map[string]string) []string {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,131 @@
+package trace_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"runny/src/trace"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStart(t *testing.T) {
+	t.Run("nothing is traced without a tracer", func(t *testing.T) {
+		ctx, span := trace.Start(context.Background(), "load", "runny.rny")
+		assert.Nil(t, span)
+		assert.Equal(t, context.Background(), ctx)
+		// spans are safe to use when tracing is off
+		span.SetAttribute("file", "runny.rny")
+		span.Fail(errors.New("failed"))
+		span.Finish()
+	})
+	t.Run("spans are nested in the context's span", func(t *testing.T) {
+		tracer := trace.New()
+		ctx, parent := trace.Start(trace.WithTracer(context.Background(), tracer), "target", "build", "file", "runny.rny")
+		_, child := trace.Start(ctx, "action", "runny.rny:2")
+		child.Fail(errors.New("exit status 1"))
+		child.Finish()
+		parent.Finish()
+
+		spans := tracer.Spans()
+		assert.Len(t, spans, 2)
+		assert.Equal(t, map[string]string{"file": "runny.rny"}, spans[0].Attributes)
+		assert.Equal(t, "exit status 1", spans[1].Error)
+		assert.False(t, spans[1].End.Before(spans[1].Start))
+	})
+}
+
+func TestTracer_WriteChrome(t *testing.T) {
+	tracer := trace.New()
+	ctx, parent := trace.Start(trace.WithTracer(context.Background(), tracer), "target", "build")
+	// siblings running at the same time are drawn in their own lanes
+	_, first := trace.Start(ctx, "iteration", "x a")
+	_, second := trace.Start(ctx, "iteration", "x b")
+	second.Finish()
+	first.Fail(errors.New("failed"))
+	first.Finish()
+	parent.Finish()
+
+	var out bytes.Buffer
+	assert.NoError(t, tracer.WriteChrome(&out))
+	var decoded struct {
+		TraceEvents []struct {
+			Name string
+			Cat  string
+			Ph   string
+			Ts   int64
+			Dur  int64
+			Tid  int
+			Args map[string]string
+		}
+		DisplayTimeUnit string
+	}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, "ms", decoded.DisplayTimeUnit)
+	assert.Len(t, decoded.TraceEvents, 3)
+	assert.Equal(t, "build", decoded.TraceEvents[0].Name)
+	assert.Equal(t, "target", decoded.TraceEvents[0].Cat)
+	assert.Equal(t, "X", decoded.TraceEvents[0].Ph)
+	assert.Equal(t, int64(0), decoded.TraceEvents[0].Ts)
+	assert.Equal(t, 0, decoded.TraceEvents[0].Tid)
+	assert.Equal(t, 0, decoded.TraceEvents[1].Tid)
+	assert.Equal(t, 1, decoded.TraceEvents[2].Tid)
+	assert.Equal(t, map[string]string{"error": "failed"}, decoded.TraceEvents[1].Args)
+}
+
+func TestTracer_WriteOTLP(t *testing.T) {
+	tracer := trace.New()
+	ctx, parent := trace.Start(trace.WithTracer(context.Background(), tracer), "load", "runny.rny")
+	_, child := trace.Start(ctx, "load", "parse", "file", "runny.rny")
+	child.Fail(errors.New("expected '}'"))
+	child.Finish()
+	parent.Finish()
+
+	var out bytes.Buffer
+	assert.NoError(t, tracer.WriteOTLP(&out))
+	type attribute struct {
+		Key   string
+		Value struct{ StringValue string }
+	}
+	var decoded struct {
+		ResourceSpans []struct {
+			Resource   struct{ Attributes []attribute }
+			ScopeSpans []struct {
+				Scope struct{ Name string }
+				Spans []struct {
+					TraceID           string
+					SpanID            string
+					ParentSpanID      string
+					Name              string
+					StartTimeUnixNano string
+					EndTimeUnixNano   string
+					Attributes        []attribute
+					Status            struct {
+						Code    int
+						Message string
+					}
+				}
+			}
+		}
+	}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Len(t, decoded.ResourceSpans, 1)
+	assert.Equal(t, "runny", decoded.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	spans := decoded.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(t, spans, 2)
+	assert.Len(t, spans[0].TraceID, 32)
+	assert.Equal(t, spans[0].TraceID, spans[1].TraceID)
+	assert.Len(t, spans[0].SpanID, 16)
+	assert.Empty(t, spans[0].ParentSpanID)
+	assert.Equal(t, spans[0].SpanID, spans[1].ParentSpanID)
+	assert.NotEmpty(t, spans[1].StartTimeUnixNano)
+	assert.Equal(t, 1, spans[0].Status.Code)
+	assert.Equal(t, 2, spans[1].Status.Code)
+	assert.Equal(t, "expected '}'", spans[1].Status.Message)
+	assert.Equal(t, []attribute{
+		{Key: "runny.category", Value: struct{ StringValue string }{"load"}},
+		{Key: "file", Value: struct{ StringValue string }{"runny.rny"}},
+	}, spans[1].Attributes)
+}
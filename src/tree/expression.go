@@ -1,17 +1,69 @@
 package tree
 
+import "runny/src/token"
+
 type Expression interface {
 	Accept(visitor ExpressionVisitor) interface{}
+	Where() token.Span
 }
 
 type ExpressionVisitor interface {
 	VisitLiteralExpr(expr Literal) interface{}
+	VisitReferenceExpr(expr Reference) interface{}
+	VisitListExpr(expr List) interface{}
+	VisitMapExpr(expr Map) interface{}
+	VisitCallExpr(expr Call) interface{}
 }
 
 type Literal struct {
+	Node
 	Value interface{}
 }
 
 func (l Literal) Accept(visitor ExpressionVisitor) interface{} {
 	return visitor.VisitLiteralExpr(l)
 }
+
+// a variable used in an expression e.g. $name
+type Reference struct {
+	Node
+	Name token.Token
+}
+
+func (r Reference) Accept(visitor ExpressionVisitor) interface{} {
+	return visitor.VisitReferenceExpr(r)
+}
+
+type List struct {
+	Node
+	Items []Expression
+}
+
+func (l List) Accept(visitor ExpressionVisitor) interface{} {
+	return visitor.VisitListExpr(l)
+}
+
+type Map struct {
+	Node
+	Items []MapItem
+}
+
+type MapItem struct {
+	Key   token.Token
+	Value Expression
+}
+
+func (m Map) Accept(visitor ExpressionVisitor) interface{} {
+	return visitor.VisitMapExpr(m)
+}
+
+// a call to a built-in function e.g. glob("*.go")
+type Call struct {
+	Node
+	Callee    token.Token
+	Arguments []Expression
+}
+
+func (c Call) Accept(visitor ExpressionVisitor) interface{} {
+	return visitor.VisitCallExpr(c)
+}
@@ -0,0 +1,12 @@
+package tree
+
+import "runny/src/token"
+
+// Node is part of every statement and expression, recording where it was read from
+type Node struct {
+	Span token.Span
+}
+
+func (n Node) Where() token.Span {
+	return n.Span
+}
@@ -6,6 +6,7 @@ import (
 
 type Statement interface {
 	Accept(visitor StatementVisitor) interface{}
+	Where() token.Span
 }
 
 type StatementVisitor interface {
@@ -16,11 +17,20 @@ type StatementVisitor interface {
 	VisitRunStatement(statement RunStatement) interface{}
 	VisitDescribeStatement(statement DescribeStatement) interface{}
 	VisitExtendsStatement(statement ExtendsStatement) interface{}
+	VisitImportStatement(statement ImportStatement) interface{}
+	VisitEnvStatement(statement EnvStatement) interface{}
+	VisitIfStatement(statement IfStatement) interface{}
+	VisitForStatement(statement ForStatement) interface{}
+	VisitTestStatement(statement TestStatement) interface{}
+	VisitMockStatement(statement MockStatement) interface{}
+	VisitExpectStatement(statement ExpectStatement) interface{}
 	VisitExpressionStatement(statement ExpressionStatement) interface{}
 }
 
 type ConfigStatement struct {
+	Node
 	Items []Config
+	Env   []EnvStatement // env blocks in the config e.g. config { env { CI "true" } }
 }
 
 type Config struct {
@@ -33,8 +43,10 @@ func (c ConfigStatement) Accept(visitor StatementVisitor) interface{} {
 }
 
 type VariableStatement struct {
-	Items []Variable
-	Stage Stage
+	Node
+	Items  []Variable
+	Stage  Stage
+	Secret bool // values are masked wherever runny prints them
 }
 
 type Variable struct {
@@ -47,6 +59,7 @@ func (vs VariableStatement) Accept(visitor StatementVisitor) interface{} {
 }
 
 type TargetStatement struct {
+	Node
 	Name token.Token
 	Body []Statement
 }
@@ -56,6 +69,7 @@ func (ts TargetStatement) Accept(visitor StatementVisitor) interface{} {
 }
 
 type ActionStatement struct {
+	Node
 	Body token.Token
 }
 
@@ -72,9 +86,11 @@ const (
 )
 
 type RunStatement struct {
-	Name  token.Token
-	Body  []Statement
-	Stage Stage
+	Node
+	Name   token.Token
+	Body   []Statement
+	Stage  Stage
+	Silent bool // scripts run by the block aren't printed
 }
 
 func (rs RunStatement) Accept(visitor StatementVisitor) interface{} {
@@ -82,6 +98,7 @@ func (rs RunStatement) Accept(visitor StatementVisitor) interface{} {
 }
 
 type DescribeStatement struct {
+	Node
 	Name  token.Token
 	Lines []Literal
 }
@@ -91,14 +108,104 @@ func (ds DescribeStatement) Accept(visitor StatementVisitor) interface{} {
 }
 
 type ExtendsStatement struct {
+	Node
 	Paths []Expression
+	Files []File // filled in by the loader, one per path
+}
+
+// File is a file that has been extended or imported
+type File struct {
+	Path       string // where the file was read from
+	Statements []Statement
+	Skipped    []Statement // top-level runs, which only run in the file runny was started with
 }
 
 func (es ExtendsStatement) Accept(visitor StatementVisitor) interface{} {
 	return visitor.VisitExtendsStatement(es)
 }
 
+// ImportStatement loads a file into its own namespace e.g. import "ci.rny" as ci
+type ImportStatement struct {
+	Node
+	Path  Expression
+	Alias token.Token
+	File  *File // filled in by the loader
+}
+
+func (is ImportStatement) Accept(visitor StatementVisitor) interface{} {
+	return visitor.VisitImportStatement(is)
+}
+
+// EnvStatement sets environment variables for the commands in its scope
+type EnvStatement struct {
+	Node
+	Items []Variable
+}
+
+func (es EnvStatement) Accept(visitor StatementVisitor) interface{} {
+	return visitor.VisitEnvStatement(es)
+}
+
+type IfStatement struct {
+	Node
+	Condition Expression
+	Then      []Statement
+	Else      []Statement
+}
+
+func (is IfStatement) Accept(visitor StatementVisitor) interface{} {
+	return visitor.VisitIfStatement(is)
+}
+
+type ForStatement struct {
+	Node
+	Name     token.Token
+	Iterable Expression
+	Body     []Statement
+	Parallel bool
+}
+
+func (fs ForStatement) Accept(visitor StatementVisitor) interface{} {
+	return visitor.VisitForStatement(fs)
+}
+
+// TestStatement is a test of the file's targets, run by runny test
+type TestStatement struct {
+	Node
+	Name token.Token // a string e.g. test "build makes a binary" { ... }
+	Body []Statement
+}
+
+func (ts TestStatement) Accept(visitor StatementVisitor) interface{} {
+	return visitor.VisitTestStatement(ts)
+}
+
+// MockStatement replaces a command for the rest of a test e.g. mock docker { echo "docker $@" }
+type MockStatement struct {
+	Node
+	Name token.Token
+	Body token.Token // the script run in place of the command
+}
+
+func (ms MockStatement) Accept(visitor StatementVisitor) interface{} {
+	return visitor.VisitMockStatement(ms)
+}
+
+// ExpectStatement checks what a test has run so far e.g. expect output contains "built"
+type ExpectStatement struct {
+	Node
+	Keyword  token.Token // where the expectation is, for failures
+	Subject  token.Token // output, stdout, stderr or exit
+	Operator token.Token // contains, equals or matches, unless the subject is exit
+	Expected Expression
+}
+
+func (es ExpectStatement) Accept(visitor StatementVisitor) interface{} {
+	return visitor.VisitExpectStatement(es)
+}
+
 type ExpressionStatement struct {
+	Node
 	Expression Expression
 }
 
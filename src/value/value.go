@@ -0,0 +1,152 @@
+package value
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type Type int
+
+const (
+	StringType Type = iota
+	NumberType
+	BoolType
+	ListType
+	MapType
+)
+
+var TypeNames = map[Type]string{
+	StringType: "string",
+	NumberType: "number",
+	BoolType:   "bool",
+	ListType:   "list",
+	MapType:    "map",
+}
+
+func (t Type) String() string {
+	return TypeNames[t]
+}
+
+type Value interface {
+	Type() Type
+	String() string
+}
+
+type String string
+
+func (s String) Type() Type {
+	return StringType
+}
+
+func (s String) String() string {
+	return string(s)
+}
+
+type Number float64
+
+func (n Number) Type() Type {
+	return NumberType
+}
+
+func (n Number) String() string {
+	return strconv.FormatFloat(float64(n), 'f', -1, 64)
+}
+
+type Bool bool
+
+func (b Bool) Type() Type {
+	return BoolType
+}
+
+func (b Bool) String() string {
+	return strconv.FormatBool(bool(b))
+}
+
+type List []Value
+
+func (l List) Type() Type {
+	return ListType
+}
+
+// lists are space-joined so they can be looped over in a shell
+func (l List) String() string {
+	items := make([]string, 0, len(l))
+	for _, item := range l {
+		items = append(items, item.String())
+	}
+	return strings.Join(items, " ")
+}
+
+type Map map[string]Value
+
+func (m Map) Type() Type {
+	return MapType
+}
+
+// maps are represented by their space-joined keys
+func (m Map) String() string {
+	return strings.Join(m.Keys(), " ")
+}
+
+// Keys returns the map's keys in sorted order
+func (m Map) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Parse converts text from outside of a runny file (e.g. --set name=value)
+// into the value it looks like
+func Parse(text string) Value {
+	switch text {
+	case "true":
+		return Bool(true)
+	case "false":
+		return Bool(false)
+	}
+	if number, err := strconv.ParseFloat(text, 64); err == nil {
+		return Number(number)
+	}
+	return String(text)
+}
+
+func Truthy(v Value) bool {
+	switch typed := v.(type) {
+	case nil:
+		return false
+	case Bool:
+		return bool(typed)
+	case Number:
+		return typed != 0
+	case String:
+		return typed != ""
+	case List:
+		return len(typed) > 0
+	case Map:
+		return len(typed) > 0
+	}
+	return false
+}
+
+// Export converts a variable into "name=value" pairs for a shell environment.
+// Lists and maps are exported both as a single joined variable and as one
+// variable per item, e.g. files_0, files_1 or config_host.
+func Export(name string, v Value) []string {
+	pairs := []string{fmt.Sprintf("%s=%s", name, v)}
+	switch typed := v.(type) {
+	case List:
+		for index, item := range typed {
+			pairs = append(pairs, Export(fmt.Sprintf("%s_%d", name, index), item)...)
+		}
+	case Map:
+		for _, key := range typed.Keys() {
+			pairs = append(pairs, Export(fmt.Sprintf("%s_%s", name, key), typed[key])...)
+		}
+	}
+	return pairs
+}
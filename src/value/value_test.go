@@ -0,0 +1,43 @@
+package value
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	assert.Equal(t, Bool(true), Parse("true"))
+	assert.Equal(t, Number(80), Parse("80"))
+	assert.Equal(t, String("tim"), Parse("tim"))
+}
+
+func TestTruthy(t *testing.T) {
+	assert.True(t, Truthy(Bool(true)))
+	assert.False(t, Truthy(Bool(false)))
+	assert.False(t, Truthy(Number(0)))
+	assert.False(t, Truthy(String("")))
+	assert.True(t, Truthy(List{String("a")}))
+	assert.False(t, Truthy(nil))
+}
+
+func TestExport(t *testing.T) {
+	t.Run("scalars are exported as-is", func(t *testing.T) {
+		assert.Equal(t, []string{"ratio=0.5"}, Export("ratio", Number(0.5)))
+		assert.Equal(t, []string{"debug=false"}, Export("debug", Bool(false)))
+	})
+	t.Run("lists are exported joined and indexed", func(t *testing.T) {
+		assert.Equal(t, []string{
+			"files=a.go b.go",
+			"files_0=a.go",
+			"files_1=b.go",
+		}, Export("files", List{String("a.go"), String("b.go")}))
+	})
+	t.Run("maps are exported by key", func(t *testing.T) {
+		assert.Equal(t, []string{
+			"server=host port",
+			"server_host=localhost",
+			"server_port=8080",
+		}, Export("server", Map{"port": Number(8080), "host": String("localhost")}))
+	})
+}
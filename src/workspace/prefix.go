@@ -0,0 +1,18 @@
+package workspace
+
+import (
+	"fmt"
+	"io"
+	"runny/src/interpreter"
+	"sync"
+)
+
+// newPrefixWriter writes whole lines to out with a prefix. Writers sharing out
+// share a mutex so lines from packages running in parallel don't interleave.
+func newPrefixWriter(out io.Writer, mutex *sync.Mutex, prefix string) *interpreter.LineWriter {
+	return &interpreter.LineWriter{Line: func(line string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fmt.Fprintf(out, "%s%s\n", prefix, line)
+	}}
+}
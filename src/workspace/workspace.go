@@ -0,0 +1,256 @@
+// Package workspace finds runny files in a directory tree, like one per service
+// in a monorepo, and runs targets across them.
+package workspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runny/src/runny"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FileName is the runny file looked for in each directory
+const FileName = "runny.rny"
+
+// Find searches dir and its parents for the nearest runny file
+func Find(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		file := filepath.Join(dir, FileName)
+		if _, err := os.Stat(file); err == nil {
+			return file, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("%s not found in this directory or any of its parents", FileName)
+		}
+		dir = parent
+	}
+}
+
+type Workspace struct {
+	Root     string    // the directory packages are found in
+	Packages []Package // sorted by directory, the root package first
+}
+
+type Package struct {
+	Dir  string // relative to the workspace root, "." for the root itself
+	File string
+}
+
+// Discover finds every runny file under root. Hidden directories, dependency
+// directories like node_modules and directories that can't be read aren't searched.
+func Discover(root string) (*Workspace, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	workspace := &Workspace{
+		Root: root,
+	}
+	if err := filepath.WalkDir(root, workspace.visit); err != nil {
+		return nil, err
+	}
+	sort.Slice(workspace.Packages, func(a, b int) bool {
+		return workspace.Packages[a].Dir < workspace.Packages[b].Dir
+	})
+	return workspace, nil
+}
+
+// adds the runny files Discover walks over as packages
+func (w *Workspace) visit(path string, entry fs.DirEntry, err error) error {
+	if err != nil {
+		// one unreadable directory shouldn't stop the rest of the workspace being found
+		if path != w.Root && entry != nil && entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return err
+	}
+	if entry.IsDir() {
+		if path != w.Root && skipDir(entry.Name()) {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	if entry.Name() != FileName {
+		return nil
+	}
+	dir, err := filepath.Rel(w.Root, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	w.Packages = append(w.Packages, Package{
+		Dir:  filepath.ToSlash(dir),
+		File: path,
+	})
+	return nil
+}
+
+func skipDir(name string) bool {
+	return strings.HasPrefix(name, ".") || name == "node_modules" || name == "vendor"
+}
+
+// Package returns the package in dir e.g. "services/api"
+func (w *Workspace) Package(dir string) (Package, bool) {
+	dir = filepath.ToSlash(filepath.Clean(dir))
+	for _, pkg := range w.Packages {
+		if pkg.Dir == dir {
+			return pkg, true
+		}
+	}
+	return Package{}, false
+}
+
+// Resolve splits a target addressed like services/api:build into its package
+// and target. Targets that don't start with a package's directory aren't
+// addressed to a package, e.g. build or an imported ci:build.
+func (w *Workspace) Resolve(target string) (Package, string, bool) {
+	dir, name, found := strings.Cut(target, ":")
+	if !found || dir == "." {
+		return Package{}, "", false
+	}
+	pkg, ok := w.Package(dir)
+	if !ok || pkg.Dir == "." {
+		return Package{}, "", false
+	}
+	return pkg, name, true
+}
+
+type Options struct {
+	runny.Options
+	Load runny.LoadOptions
+	// run every package at the same time rather than one after another
+	Parallel bool
+}
+
+// events say which package they came from instead of output being prefixed
+type packageHandler struct {
+	handler runny.Handler
+	dir     string
+}
+
+func (h packageHandler) Handle(event runny.Event) {
+	event.Package = h.dir
+	h.handler.Handle(event)
+}
+
+type Result struct {
+	Package Package
+	*runny.Result
+	Err error
+}
+
+// Run runs a target in every package that defines it. Each package's commands run
+// in its own directory and their output is prefixed with the directory. The first
+// failure stops the other packages.
+func (w *Workspace) Run(ctx context.Context, target string, opts Options) ([]Result, error) {
+	stdout, stderr := opts.Stdout, opts.Stderr
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if stderr == nil {
+		stderr = os.Stderr
+	}
+	var outMutex, errMutex sync.Mutex
+
+	var projects []*runny.Project
+	var packages []Package
+	for _, pkg := range w.Packages {
+		project, err := runny.Load(ctx, pkg.File, opts.Load)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pkg.Dir, err)
+		}
+		if _, defined := project.Target(target); !defined {
+			continue
+		}
+		for _, warning := range project.Warnings {
+			fmt.Fprintf(stderr, "[%s] warning: %s\n", pkg.Dir, warning)
+		}
+		projects = append(projects, project)
+		packages = append(packages, pkg)
+	}
+	if len(projects) == 0 {
+		return nil, fmt.Errorf("no package defines target '%s'", target)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]Result, len(projects))
+	run := func(index int) {
+		pkg := packages[index]
+		out := newPrefixWriter(stdout, &outMutex, "["+pkg.Dir+"] ")
+		err := newPrefixWriter(stderr, &errMutex, "["+pkg.Dir+"] ")
+		defer out.Flush()
+		defer err.Flush()
+
+		runOpts := opts.Options
+		runOpts.Stdout = out
+		runOpts.Stderr = err
+		runOpts.Dir = filepath.Dir(pkg.File)
+		if opts.Handler != nil {
+			runOpts.Handler = packageHandler{handler: opts.Handler, dir: pkg.Dir}
+		}
+		runOpts.Listeners = nil
+		for _, listener := range opts.Listeners {
+			runOpts.Listeners = append(runOpts.Listeners, packageHandler{handler: listener, dir: pkg.Dir})
+		}
+		result, runErr := projects[index].Run(ctx, target, runOpts)
+		results[index] = Result{Package: pkg, Result: result, Err: runErr}
+		if runErr != nil {
+			cancel()
+		}
+	}
+
+	if opts.Parallel {
+		var wg sync.WaitGroup
+		for index := range projects {
+			wg.Add(1)
+			go func(index int) {
+				defer wg.Done()
+				run(index)
+			}(index)
+		}
+		wg.Wait()
+	} else {
+		for index := range projects {
+			if ctx.Err() != nil {
+				break
+			}
+			run(index)
+		}
+	}
+
+	// packages after a failure don't run
+	ran := make([]Result, 0, len(results))
+	for _, result := range results {
+		if result.Result != nil {
+			ran = append(ran, result)
+		}
+	}
+
+	// report the failure that stopped the others
+	var cancelled error
+	for _, result := range ran {
+		if result.Err == nil {
+			continue
+		}
+		err := fmt.Errorf("[%s] %w", result.Package.Dir, result.Err)
+		if !errors.Is(result.Err, context.Canceled) {
+			return ran, err
+		}
+		if cancelled == nil {
+			cancelled = err
+		}
+	}
+	return ran, cancelled
+}
@@ -0,0 +1,132 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runny/src/runny"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// creates files from a map of relative paths to contents
+func writeFiles(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(root, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+	}
+	return root
+}
+
+func TestFind(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"runny.rny":             `target build { run { echo "root" } }`,
+		"services/api/src/a.go": "package a",
+	})
+
+	file, err := Find(filepath.Join(root, "services", "api", "src"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "runny.rny"), file)
+
+	_, err = Find(t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestDiscover(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"runny.rny":                   `target build { run { echo "root" } }`,
+		"services/api/runny.rny":      `target build { run { echo "api" } }`,
+		"services/web/runny.rny":      `target build { run { echo "web" } }`,
+		".git/runny.rny":              `target build { run { echo "hidden" } }`,
+		"node_modules/dep/runny.rny":  `target build { run { echo "dependency" } }`,
+		"services/web/other/file.rny": `target build { run { echo "not a package" } }`,
+	})
+
+	ws, err := Discover(root)
+	assert.NoError(t, err)
+	dirs := make([]string, 0, len(ws.Packages))
+	for _, pkg := range ws.Packages {
+		dirs = append(dirs, pkg.Dir)
+	}
+	assert.Equal(t, []string{".", "services/api", "services/web"}, dirs)
+
+	pkg, target, ok := ws.Resolve("services/api:build")
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(root, "services", "api", "runny.rny"), pkg.File)
+	assert.Equal(t, "build", target)
+
+	_, _, ok = ws.Resolve("ci:build")
+	assert.False(t, ok)
+	_, _, ok = ws.Resolve("build")
+	assert.False(t, ok)
+
+	t.Run("unreadable directories are skipped", func(t *testing.T) {
+		ws := &Workspace{Root: root}
+		info, err := os.Stat(filepath.Join(root, "services"))
+		assert.NoError(t, err)
+		unreadable := fs.FileInfoToDirEntry(info)
+		assert.Equal(t, filepath.SkipDir, ws.visit(filepath.Join(root, "services"), unreadable, fs.ErrPermission))
+		assert.ErrorIs(t, ws.visit(root, unreadable, fs.ErrPermission), fs.ErrPermission)
+	})
+}
+
+func TestWorkspace_Run(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"runny.rny":              `target build { run { echo "root" } }`,
+		"services/api/runny.rny": `target build { run { echo "api in $(basename "$PWD")" } }`,
+		"services/web/runny.rny": `target test { run { echo "web test" } }`,
+		"services/bad/runny.rny": `target fail { run { echo "failed" >&2; exit 3 } }`,
+		"services/zzz/runny.rny": `target fail { run { echo "never runs" } }`,
+	})
+	ws, err := Discover(root)
+	assert.NoError(t, err)
+
+	for _, parallel := range []bool{false, true} {
+		var stdout bytes.Buffer
+		results, err := ws.Run(context.Background(), "build", Options{
+			Options:  runny.Options{Stdout: &stdout},
+			Parallel: parallel,
+		})
+		assert.NoError(t, err)
+		assert.Len(t, results, 2)
+		// packages without the target are skipped
+		assert.Contains(t, stdout.String(), "[.] root\n")
+		assert.Contains(t, stdout.String(), "[services/api] api in api\n")
+		assert.NotContains(t, stdout.String(), "web")
+	}
+
+	t.Run("failures stop later packages", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		results, err := ws.Run(context.Background(), "fail", Options{
+			Options: runny.Options{Stdout: &stdout, Stderr: &stderr},
+		})
+		assert.ErrorContains(t, err, "[services/bad] runtime error")
+		assert.Len(t, results, 1)
+		assert.Equal(t, 3, results[0].ExitCode)
+		assert.Equal(t, "[services/bad] failed\n", stderr.String())
+		assert.NotContains(t, stdout.String(), "never runs")
+	})
+	t.Run("undefined targets", func(t *testing.T) {
+		_, err := ws.Run(context.Background(), "nope", Options{})
+		assert.EqualError(t, err, "no package defines target 'nope'")
+	})
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	var mutex sync.Mutex
+	writer := newPrefixWriter(&out, &mutex, "[api] ")
+	writer.Write([]byte("one\ntw"))
+	writer.Write([]byte("o\nthree"))
+	assert.Equal(t, "[api] one\n[api] two\n", out.String())
+	writer.Flush()
+	assert.Equal(t, 3, strings.Count(out.String(), "[api] "))
+	assert.True(t, strings.HasSuffix(out.String(), "[api] three\n"))
+}